@@ -0,0 +1,117 @@
+// pbctl talks to a primary/backup key/value service.
+//
+//	pbctl -vs tcp://10.0.0.1:7000 get KEY
+//	pbctl -vs tcp://10.0.0.1:7000 put KEY VALUE
+//	pbctl -vs tcp://10.0.0.1:7000 append KEY VALUE
+//	pbctl -vs tcp://10.0.0.1:7000 view
+//	pbctl -vs tcp://10.0.0.1:7000 watch
+//
+// -vs may list several replicated viewservice peers, separated
+// by commas; every command asks whichever of them answers.
+// watch prints every new view until interrupted.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"umich.edu/eecs491/proj2/pbservice"
+	"umich.edu/eecs491/proj2/transport"
+	"umich.edu/eecs491/proj2/viewservice"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: pbctl [flags] get KEY | put KEY VALUE | append KEY VALUE | view | watch\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func printView(v viewservice.View) {
+	fmt.Printf("view %v: primary %q, backups %q\n", v.Viewnum, v.Primary, v.Backups)
+}
+
+func main() {
+	vshosts := flag.String("vs", "", "viewservice address(es) (required)")
+	tlsCert := flag.String("tls-cert", "", "certificate for tls:// addresses")
+	tlsKey := flag.String("tls-key", "", "key for -tls-cert")
+	tlsCA := flag.String("tls-ca", "", "CA that signs every server's certificate")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if *vshosts == "" || len(args) == 0 {
+		usage()
+	}
+	if *tlsCert != "" {
+		server, client, err := transport.MutualTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Fatal("tls: ", err)
+		}
+		transport.Register("tls", transport.NewTLS(server, client))
+	}
+	peers := strings.Split(*vshosts, ",")
+
+	// the service remembers operations by client name, and every
+	// pbctl run starts its sequence numbers over, so each run
+	// needs a name of its own.
+	me := fmt.Sprintf("pbctl-%v-%v", os.Getpid(), time.Now().UnixNano())
+
+	need := func(n int) {
+		if len(args) != n+1 {
+			usage()
+		}
+	}
+
+	switch args[0] {
+	case "get":
+		need(1)
+		ck := pbservice.MakeReplicatedClerk(peers, me)
+		fmt.Println(ck.Get(args[1]))
+		ck.Close()
+	case "put":
+		need(2)
+		ck := pbservice.MakeReplicatedClerk(peers, me)
+		err := ck.Put(args[1], args[2])
+		ck.Close()
+		if err != pbservice.OK {
+			log.Fatal("put: ", err)
+		}
+	case "append":
+		need(2)
+		ck := pbservice.MakeReplicatedClerk(peers, me)
+		err := ck.Append(args[1], args[2])
+		ck.Close()
+		if err != pbservice.OK {
+			log.Fatal("append: ", err)
+		}
+	case "view":
+		need(0)
+		vck := viewservice.MakeReplicatedClerk("", peers)
+		v, ok := vck.Get()
+		if !ok {
+			log.Fatal("no viewservice answered")
+		}
+		printView(v)
+	case "watch":
+		need(0)
+		vck := viewservice.MakeReplicatedClerk("", peers)
+		views, stop := vck.Subscribe()
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			stop()
+		}()
+		for v := range views {
+			printView(v)
+		}
+	default:
+		usage()
+	}
+}
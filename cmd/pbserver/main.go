@@ -0,0 +1,62 @@
+// pbserver runs one primary/backup key/value server until it
+// gets SIGINT or SIGTERM.
+//
+//	pbserver -vs tcp://10.0.0.1:7000 -addr tcp://10.0.0.5:7100 -data /var/lib/pb
+//
+// -vs may list several replicated viewservice peers, separated
+// by commas; the server pings whichever of them answers.
+// Addresses may be unix socket paths, tcp://host:port or, with
+// -tls-cert, -tls-key and -tls-ca, tls://host:port.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"umich.edu/eecs491/proj2/pbservice"
+	"umich.edu/eecs491/proj2/transport"
+	"umich.edu/eecs491/proj2/viewservice"
+)
+
+func main() {
+	vshosts := flag.String("vs", "", "viewservice address(es) (required)")
+	addr := flag.String("addr", "", "address to listen on (required)")
+	pingInterval := flag.Duration("ping-interval", viewservice.PingInterval,
+		"how often to ping until the viewservice says otherwise")
+	dataDir := flag.String("data", "", "directory to keep state in across restarts")
+	snapshotEvery := flag.Int("snapshot-every", pbservice.DefaultSnapshotEvery,
+		"ops to log between snapshots of the state in -data")
+	tlsCert := flag.String("tls-cert", "", "certificate for tls:// addresses")
+	tlsKey := flag.String("tls-key", "", "key for -tls-cert")
+	tlsCA := flag.String("tls-ca", "", "CA that signs every peer's certificate")
+	flag.Parse()
+
+	if *vshosts == "" || *addr == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *tlsCert != "" {
+		server, client, err := transport.MutualTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Fatal("tls: ", err)
+		}
+		transport.Register("tls", transport.NewTLS(server, client))
+	}
+
+	cfg := pbservice.Config{PingInterval: *pingInterval, DataDir: *dataDir,
+		SnapshotEvery: *snapshotEvery}
+	term := make(chan interface{})
+	peers := strings.Split(*vshosts, ",")
+	pb := pbservice.StartReplicatedServer(peers, *addr, cfg, term)
+	log.Printf("pbserver listening on %v\n", *addr)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	log.Printf("pbserver got %v, shutting down\n", sig)
+	pb.Kill(term)
+}
@@ -0,0 +1,76 @@
+// viewserver runs one viewservice server, or one peer of a
+// replicated viewservice, until it gets SIGINT or SIGTERM.
+//
+//	viewserver -addr tcp://10.0.0.1:7000 -log /var/lib/vs/views.log
+//	viewserver -addr tcp://10.0.0.1:7000 -log /var/lib/vs/peer.log -peers tcp://10.0.0.1:7000,tcp://10.0.0.2:7000,tcp://10.0.0.3:7000
+//
+// A replicated peer needs its own -log, which it can be
+// restarted on after a crash.
+// Addresses may be unix socket paths, tcp://host:port or, with
+// -tls-cert, -tls-key and -tls-ca, tls://host:port.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"umich.edu/eecs491/proj2/transport"
+	"umich.edu/eecs491/proj2/viewservice"
+)
+
+func main() {
+	addr := flag.String("addr", "", "address to listen on (required)")
+	logFile := flag.String("log", "", "file to keep the view log (or, with -peers, this peer's state) in")
+	peers := flag.String("peers", "", "comma-separated addresses of all replicated peers, including -addr")
+	backups := flag.Int("backups", 1, "backups per view")
+	pingInterval := flag.Duration("ping-interval", viewservice.PingInterval, "how often servers should ping")
+	deadPings := flag.Int("dead-pings", viewservice.DeadPings, "missed pings before a server is dead")
+	detector := flag.String("detector", viewservice.CounterDetector, "failure detector: counter or phi")
+	phiThreshold := flag.Float64("phi-threshold", viewservice.DefaultPhiThreshold, "suspicion level for the phi detector")
+	history := flag.Int("history", viewservice.DefaultHistorySize, "view changes to remember")
+	lease := flag.Duration("lease", 0, "primary's read lease per ping (0: dead-pings-1 intervals, <0: none)")
+	tlsCert := flag.String("tls-cert", "", "certificate for tls:// addresses")
+	tlsKey := flag.String("tls-key", "", "key for -tls-cert")
+	tlsCA := flag.String("tls-ca", "", "CA that signs every peer's certificate")
+	flag.Parse()
+
+	if *addr == "" || (*peers != "" && *logFile == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *tlsCert != "" {
+		server, client, err := transport.MutualTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Fatal("tls: ", err)
+		}
+		transport.Register("tls", transport.NewTLS(server, client))
+	}
+
+	cfg := viewservice.Config{
+		LogFile:      *logFile,
+		Backups:      *backups,
+		PingInterval: *pingInterval,
+		DeadPings:    *deadPings,
+		Detector:     *detector,
+		PhiThreshold: *phiThreshold,
+		HistorySize:  *history,
+		Lease:        *lease,
+	}
+	if *peers != "" {
+		cfg.Peers = strings.Split(*peers, ",")
+	}
+
+	term := make(chan interface{})
+	vs := viewservice.StartServerWithConfig(*addr, cfg, term)
+	log.Printf("viewserver listening on %v\n", *addr)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	log.Printf("viewserver got %v, shutting down\n", sig)
+	vs.Kill(term)
+}
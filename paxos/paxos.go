@@ -0,0 +1,471 @@
+package paxos
+
+//
+// Paxos library, to be included in a service that needs a
+// sequence of agreed-upon values. The service registers the
+// Paxos RPC handlers on its own rpc.Server, so that Paxos
+// messages share the service's listener.
+//
+// px = paxos.Make(peers []string, me int, rpcs, term)
+// px, err = paxos.MakePersistent(peers, me, rpcs, term, path)
+// px.Start(seq int, v interface{}) -- start agreement on new instance
+// px.Status(seq int) (Fate, v interface{}) -- get info about an instance
+// px.Done(seq int) -- ok to forget all instances <= seq
+// px.Max() int -- highest instance seq known, or -1
+// px.Min() int -- instances before this seq have been forgotten
+//
+// Values handed to Start() travel between peers with gob, so
+// their concrete types must be passed to gob.Register().
+//
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"umich.edu/eecs491/proj2/transport"
+)
+
+// Fate of an instance, as reported by Status().
+type Fate int
+
+const (
+	Decided   Fate = iota + 1
+	Pending        // not yet decided.
+	Forgotten      // decided but forgotten.
+)
+
+type Paxos struct {
+	mu    sync.Mutex
+	dead  <-chan interface{}
+	peers []string
+	me    int // index into peers[]
+
+	instances map[int]*instance
+	dones     []int // highest seq each peer has called Done() on
+	maxSeq    int
+	store     *store // nil unless made with MakePersistent
+}
+
+// acceptor and learner state for one instance
+type instance struct {
+	np       int64       // highest prepare seen
+	na       int64       // highest accept seen
+	va       interface{} // value of highest accept
+	decided  bool
+	decision interface{}
+}
+
+type PrepareArgs struct {
+	Seq  int
+	N    int64
+	Me   int
+	Done int
+}
+
+type PrepareReply struct {
+	OK   bool
+	Np   int64
+	Na   int64
+	Va   interface{}
+	Done int
+}
+
+type AcceptArgs struct {
+	Seq  int
+	N    int64
+	V    interface{}
+	Me   int
+	Done int
+}
+
+type AcceptReply struct {
+	OK   bool
+	Np   int64
+	Done int
+}
+
+type DecidedArgs struct {
+	Seq  int
+	V    interface{}
+	Me   int
+	Done int
+}
+
+type DecidedReply struct {
+	Done int
+}
+
+// has this peer been asked to shut down?
+func (px *Paxos) isdead() bool {
+	select {
+	case <-px.dead:
+		return true
+	default:
+		return false
+	}
+}
+
+// get (creating if needed) the state for instance seq.
+// px.mu must be held.
+func (px *Paxos) instance(seq int) *instance {
+	inst, ok := px.instances[seq]
+	if !ok {
+		inst = &instance{np: -1, na: -1}
+		px.instances[seq] = inst
+	}
+	if seq > px.maxSeq {
+		px.maxSeq = seq
+	}
+	return inst
+}
+
+// remember that peer has called Done(done), and throw away
+// any instances that every peer is finished with.
+// px.mu must be held.
+func (px *Paxos) noteDone(peer int, done int) {
+	if done > px.dones[peer] {
+		px.dones[peer] = done
+	}
+	min := px.min()
+	for seq := range px.instances {
+		if seq < min {
+			delete(px.instances, seq)
+		}
+	}
+}
+
+// make instance seq's state durable before a reply depends on
+// it. px.mu must be held.
+func (px *Paxos) persist(seq int, inst *instance) error {
+	if px.store == nil {
+		return nil
+	}
+	err := px.store.save(seq, inst, px.instances)
+	if err != nil && !px.isdead() {
+		log.Fatal("paxos store: ", err)
+	}
+	return err
+}
+
+func (px *Paxos) min() int {
+	min := px.dones[0]
+	for _, d := range px.dones {
+		if d < min {
+			min = d
+		}
+	}
+	return min + 1
+}
+
+// Prepare RPC handler (acceptor).
+func (px *Paxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	px.noteDone(args.Me, args.Done)
+	reply.Done = px.dones[px.me]
+	if args.Seq < px.min() {
+		return nil
+	}
+	inst := px.instance(args.Seq)
+	if args.N > inst.np {
+		inst.np = args.N
+		if err := px.persist(args.Seq, inst); err != nil {
+			return err
+		}
+		reply.OK = true
+		reply.Na = inst.na
+		reply.Va = inst.va
+	}
+	reply.Np = inst.np
+	return nil
+}
+
+// Accept RPC handler (acceptor).
+func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	px.noteDone(args.Me, args.Done)
+	reply.Done = px.dones[px.me]
+	if args.Seq < px.min() {
+		return nil
+	}
+	inst := px.instance(args.Seq)
+	if args.N >= inst.np {
+		inst.np = args.N
+		inst.na = args.N
+		inst.va = args.V
+		if err := px.persist(args.Seq, inst); err != nil {
+			return err
+		}
+		reply.OK = true
+	}
+	reply.Np = inst.np
+	return nil
+}
+
+// Decided RPC handler (learner).
+func (px *Paxos) Decided(args *DecidedArgs, reply *DecidedReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	px.noteDone(args.Me, args.Done)
+	reply.Done = px.dones[px.me]
+	if args.Seq < px.min() {
+		return nil
+	}
+	inst := px.instance(args.Seq)
+	if !inst.decided {
+		inst.decided = true
+		inst.decision = args.V
+		return px.persist(args.Seq, inst)
+	}
+	return nil
+}
+
+// send an RPC to peer i, short-circuiting calls to ourselves.
+// done is the Done() value peer i piggybacked on its reply.
+func (px *Paxos) send(i int, rpcname string, args interface{}, reply interface{}, done *int) bool {
+	if i == px.me {
+		var err error
+		switch rpcname {
+		case "Paxos.Prepare":
+			err = px.Prepare(args.(*PrepareArgs), reply.(*PrepareReply))
+		case "Paxos.Accept":
+			err = px.Accept(args.(*AcceptArgs), reply.(*AcceptReply))
+		case "Paxos.Decided":
+			err = px.Decided(args.(*DecidedArgs), reply.(*DecidedReply))
+		}
+		return err == nil
+	}
+	if !call(px.peers[i], rpcname, args, reply) {
+		return false
+	}
+	px.mu.Lock()
+	px.noteDone(i, *done)
+	px.mu.Unlock()
+	return true
+}
+
+// run the proposer for instance seq until it is decided.
+func (px *Paxos) propose(seq int, v interface{}) {
+	majority := len(px.peers)/2 + 1
+	highest := int64(-1)
+
+	for !px.isdead() {
+		px.mu.Lock()
+		if seq < px.min() {
+			px.mu.Unlock()
+			return
+		}
+		done := px.dones[px.me]
+		if inst := px.instance(seq); inst.decided {
+			// tell the others again; one that only accepted
+			// the value (perhaps before a crash) may never
+			// have heard it was chosen.
+			decision := inst.decision
+			px.mu.Unlock()
+			px.decide(seq, decision, done)
+			return
+		}
+		px.mu.Unlock()
+
+		// proposal numbers are unique to this peer.
+		n := (highest/int64(len(px.peers))+1)*int64(len(px.peers)) + int64(px.me)
+
+		// phase 1: prepare
+		oks := 0
+		na := int64(-1)
+		value := v
+		for i := range px.peers {
+			args := &PrepareArgs{Seq: seq, N: n, Me: px.me, Done: done}
+			var reply PrepareReply
+			if px.send(i, "Paxos.Prepare", args, &reply, &reply.Done) {
+				if reply.OK {
+					oks++
+					if reply.Na > na {
+						na = reply.Na
+						value = reply.Va
+					}
+				}
+				if reply.Np > highest {
+					highest = reply.Np
+				}
+			}
+		}
+
+		// phase 2: accept
+		if oks >= majority {
+			oks = 0
+			for i := range px.peers {
+				args := &AcceptArgs{Seq: seq, N: n, V: value, Me: px.me, Done: done}
+				var reply AcceptReply
+				if px.send(i, "Paxos.Accept", args, &reply, &reply.Done) {
+					if reply.OK {
+						oks++
+					}
+					if reply.Np > highest {
+						highest = reply.Np
+					}
+				}
+			}
+		}
+
+		// phase 3: tell everyone
+		if oks >= majority {
+			px.decide(seq, value, done)
+			return
+		}
+
+		if n > highest {
+			highest = n
+		}
+		// back off so that dueling proposers settle down.
+		time.Sleep(time.Duration(rand.Int63n(20)+5) * time.Millisecond)
+	}
+}
+
+// tell every peer that instance seq was decided on value.
+func (px *Paxos) decide(seq int, value interface{}, done int) {
+	for i := range px.peers {
+		args := &DecidedArgs{Seq: seq, V: value, Me: px.me, Done: done}
+		var reply DecidedReply
+		px.send(i, "Paxos.Decided", args, &reply, &reply.Done)
+	}
+}
+
+// the application wants paxos to start agreement on
+// instance seq, with proposed value v.
+// Start() returns right away; the application will
+// call Status() to find out if/when agreement
+// is reached.
+func (px *Paxos) Start(seq int, v interface{}) {
+	px.mu.Lock()
+	if seq < px.min() {
+		px.mu.Unlock()
+		return
+	}
+	px.instance(seq)
+	px.mu.Unlock()
+
+	go px.propose(seq, v)
+}
+
+// the application on this machine is done with
+// all instances <= seq.
+func (px *Paxos) Done(seq int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.noteDone(px.me, seq)
+}
+
+// the application wants to know the
+// highest instance sequence known to
+// this peer.
+func (px *Paxos) Max() int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.maxSeq
+}
+
+// one more than the lowest Done() value over all peers;
+// instances below it have been forgotten.
+func (px *Paxos) Min() int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.min()
+}
+
+// the application wants to know whether this
+// peer thinks an instance has been decided,
+// and if so what the agreed value is.
+func (px *Paxos) Status(seq int) (Fate, interface{}) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if seq < px.min() {
+		return Forgotten, nil
+	}
+	inst, ok := px.instances[seq]
+	if ok && inst.decided {
+		return Decided, inst.decision
+	}
+	return Pending, nil
+}
+
+// the application wants to create a paxos peer.
+// the ports of all the paxos peers (including this one)
+// are in peers[]. this servers port is peers[me].
+// the Paxos handlers are registered on rpcs, which the
+// application is already serving on peers[me].
+func Make(peers []string, me int, rpcs *rpc.Server, term <-chan interface{}) *Paxos {
+	px := &Paxos{}
+	px.peers = peers
+	px.me = me
+	px.dead = term
+	px.instances = make(map[int]*instance)
+	px.dones = make([]int, len(peers))
+	for i := range px.dones {
+		px.dones[i] = -1
+	}
+	px.maxSeq = -1
+
+	if err := rpcs.Register(px); err != nil {
+		panic(fmt.Sprintf("paxos: register: %v", err))
+	}
+	return px
+}
+
+// like Make, but the peer's acceptor state is kept in the file
+// at path, so that after a crash the peer can be made again on
+// the same file without going back on its promises.
+func MakePersistent(peers []string, me int, rpcs *rpc.Server,
+	term <-chan interface{}, path string) (*Paxos, error) {
+	s, instances, err := openStore(path)
+	if err != nil {
+		return nil, err
+	}
+	px := Make(peers, me, rpcs, term)
+	px.mu.Lock()
+	px.store = s
+	px.instances = instances
+	for seq := range instances {
+		if seq > px.maxSeq {
+			px.maxSeq = seq
+		}
+	}
+	px.mu.Unlock()
+
+	go func() {
+		<-term
+		px.mu.Lock()
+		defer px.mu.Unlock()
+		px.store.close()
+	}()
+	return px, nil
+}
+
+// call() sends an RPC to the rpcname handler on server srv
+// with arguments args, waits for the reply, and leaves the
+// reply in reply. the reply argument should be a pointer
+// to a reply structure.
+//
+// the return value is true if the server responded, and false
+// if call() was not able to contact the server.
+func call(srv string, rpcname string,
+	args interface{}, reply interface{}) bool {
+	conn, errx := transport.Dial(srv)
+	if errx != nil {
+		return false
+	}
+	c := rpc.NewClient(conn)
+	defer c.Close()
+
+	err := c.Call(rpcname, args, reply)
+	return err == nil
+}
@@ -0,0 +1,272 @@
+package paxos
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func port(tag string, host int) string {
+	s := "/var/tmp/824-"
+	s += strconv.Itoa(os.Getuid()) + "/"
+	os.Mkdir(s, 0777)
+	s += "px-"
+	s += strconv.Itoa(os.Getpid()) + "-"
+	s += tag + "-"
+	s += strconv.Itoa(host)
+	return s
+}
+
+// start a Paxos peer listening on peers[me], keeping its state
+// in the file at path if there is one.
+func startPeer(t *testing.T, peers []string, me int, path string, term chan interface{}) *Paxos {
+	rpcs := rpc.NewServer()
+	var px *Paxos
+	if path == "" {
+		px = Make(peers, me, rpcs, term)
+	} else {
+		var err error
+		px, err = MakePersistent(peers, me, rpcs, term, path)
+		if err != nil {
+			t.Fatalf("MakePersistent: %v", err)
+		}
+	}
+
+	os.Remove(peers[me])
+	l, err := net.Listen("unix", peers[me])
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	go func() {
+		<-term
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go rpcs.ServeConn(conn)
+		}
+	}()
+	return px
+}
+
+func makePeers(t *testing.T, tag string, n int) ([]*Paxos, []chan interface{}) {
+	peers := make([]string, n)
+	for i := 0; i < n; i++ {
+		peers[i] = port(tag, i)
+	}
+	pxa := make([]*Paxos, n)
+	terms := make([]chan interface{}, n)
+	for i := 0; i < n; i++ {
+		terms[i] = make(chan interface{})
+		pxa[i] = startPeer(t, peers, i, "", terms[i])
+	}
+	return pxa, terms
+}
+
+func cleanup(terms []chan interface{}) {
+	for _, term := range terms {
+		select {
+		case <-term:
+		default:
+			close(term)
+		}
+	}
+}
+
+// wait until the live peers agree on seq, and return the value.
+func waitn(t *testing.T, pxa []*Paxos, seq int, wanted int) interface{} {
+	to := 10 * time.Millisecond
+	for iters := 0; iters < 30; iters++ {
+		count := 0
+		var v interface{}
+		for _, px := range pxa {
+			if px == nil {
+				continue
+			}
+			fate, pv := px.Status(seq)
+			if fate == Decided {
+				if count > 0 && pv != v {
+					t.Fatalf("decided values do not match; seq=%v %v %v", seq, v, pv)
+				}
+				v = pv
+				count++
+			}
+		}
+		if count >= wanted {
+			return v
+		}
+		time.Sleep(to)
+		if to < time.Second {
+			to *= 2
+		}
+	}
+	t.Fatalf("too few decided; seq=%v wanted=%v", seq, wanted)
+	return nil
+}
+
+func TestBasic(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	pxa, terms := makePeers(t, "basic", 3)
+	defer cleanup(terms)
+
+	fmt.Printf("Test: Single proposer ...\n")
+
+	pxa[0].Start(0, "hello")
+	waitn(t, pxa, 0, len(pxa))
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Many proposers, same value ...\n")
+
+	for i := range pxa {
+		pxa[i].Start(1, 77)
+	}
+	if v := waitn(t, pxa, 1, len(pxa)); v != 77 {
+		t.Fatalf("wrong value %v", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Many proposers, different values ...\n")
+
+	pxa[0].Start(2, 100)
+	pxa[1].Start(2, 101)
+	pxa[2].Start(2, 102)
+	waitn(t, pxa, 2, len(pxa))
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestDeadPeer(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	pxa, terms := makePeers(t, "dead", 3)
+	defer cleanup(terms)
+
+	fmt.Printf("Test: Majority decides with a dead peer ...\n")
+
+	close(terms[2])
+	pxa[2] = nil
+	time.Sleep(50 * time.Millisecond)
+
+	pxa[0].Start(0, "x")
+	if v := waitn(t, pxa, 0, 2); v != "x" {
+		t.Fatalf("wrong value %v", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestForget(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	pxa, terms := makePeers(t, "forget", 3)
+	defer cleanup(terms)
+
+	fmt.Printf("Test: Forgetting ...\n")
+
+	for seq := 0; seq < 5; seq++ {
+		pxa[seq%3].Start(seq, seq)
+		waitn(t, pxa, seq, len(pxa))
+	}
+	for _, px := range pxa {
+		if px.Min() != 0 {
+			t.Fatalf("forgot too soon")
+		}
+		px.Done(3)
+	}
+
+	// Done() values travel on the next round of messages,
+	// so let every peer send some.
+	for i := range pxa {
+		pxa[i].Start(5+i, 5+i)
+		waitn(t, pxa, 5+i, len(pxa))
+	}
+
+	for i, px := range pxa {
+		if px.Min() != 4 {
+			t.Fatalf("peer %v: wanted Min() 4, got %v", i, px.Min())
+		}
+		if fate, _ := px.Status(2); fate != Forgotten {
+			t.Fatalf("peer %v did not forget instance 2", i)
+		}
+	}
+	if pxa[0].Max() != 7 {
+		t.Fatalf("wanted Max() 7, got %v", pxa[0].Max())
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPersistent(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const npeers = 3
+	peers := make([]string, npeers)
+	paths := make([]string, npeers)
+	for i := 0; i < npeers; i++ {
+		peers[i] = port("persist", i)
+		paths[i] = peers[i] + "-state"
+		os.Remove(paths[i])
+		defer os.Remove(paths[i])
+	}
+	start := func() ([]*Paxos, []chan interface{}) {
+		pxa := make([]*Paxos, npeers)
+		terms := make([]chan interface{}, npeers)
+		for i := 0; i < npeers; i++ {
+			terms[i] = make(chan interface{})
+			pxa[i] = startPeer(t, peers, i, paths[i], terms[i])
+		}
+		return pxa, terms
+	}
+
+	fmt.Printf("Test: Decisions survive every peer restarting ...\n")
+
+	pxa, terms := start()
+	pxa[0].Start(0, "first")
+	waitn(t, pxa, 0, npeers)
+	cleanup(terms)
+	time.Sleep(50 * time.Millisecond)
+
+	pxa, terms = start()
+	defer cleanup(terms)
+	pxa[1].Start(0, "second")
+	pxa[2].Start(0, "third")
+	if v := waitn(t, pxa, 0, npeers); v != "first" {
+		t.Fatalf("instance 0 changed to %v across a restart", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Accepted values survive a restart ...\n")
+
+	// with peer 0 gone, the restarted peers must settle on the
+	// value they accepted before, whether or not they heard it
+	// was decided.
+	pxa[0].Start(1, "accepted")
+	waitn(t, pxa[:1], 1, 1)
+	cleanup(terms[1:])
+	time.Sleep(50 * time.Millisecond)
+	for i := 1; i < npeers; i++ {
+		terms[i] = make(chan interface{})
+		pxa[i] = startPeer(t, peers, i, paths[i], terms[i])
+	}
+	close(terms[0])
+	pxa[0] = nil
+	pxa[1].Start(1, "other")
+	if v := waitn(t, pxa, 1, npeers-1); v != "accepted" {
+		t.Fatalf("instance 1 changed to %v across a restart", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,136 @@
+package paxos
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"os"
+)
+
+//
+// Durable acceptor state. A peer made with MakePersistent keeps
+// each instance's np, na and va, and the decision once it has
+// learned it, in a file. Every change is written and fsync()ed
+// before the reply that depends on it, so a peer that crashes
+// and is made again on the same file keeps the promises it made.
+//
+// The file is a gob stream of instance records; the last one
+// for a seq wins. It is rewritten from memory on startup (which
+// drops a record cut short by the crash), and again once most
+// of its records are stale, leaving out forgotten instances.
+//
+
+type record struct {
+	Seq      int
+	Np       int64
+	Na       int64
+	Va       interface{}
+	Decided  bool
+	Decision interface{}
+}
+
+type store struct {
+	path    string
+	f       *os.File
+	w       *bufio.Writer
+	enc     *gob.Encoder
+	written int // records since the file was last rewritten
+}
+
+var errClosed = errors.New("paxos: store closed")
+
+// open the store at path, returning it along with the instances
+// already in it.
+func openStore(path string) (*store, map[int]*instance, error) {
+	instances := make(map[int]*instance)
+	f, err := os.Open(path)
+	if err == nil {
+		dec := gob.NewDecoder(bufio.NewReader(f))
+		for {
+			var rec record
+			if dec.Decode(&rec) != nil {
+				// the end, or a record cut short by a crash.
+				break
+			}
+			instances[rec.Seq] = &instance{np: rec.Np, na: rec.Na, va: rec.Va,
+				decided: rec.Decided, decision: rec.Decision}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	s := &store{path: path}
+	if err := s.rewrite(instances); err != nil {
+		return nil, nil, err
+	}
+	return s, instances, nil
+}
+
+// replace the file with one holding just instances.
+func (s *store) rewrite(instances map[int]*instance) error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	for seq, inst := range instances {
+		if err := enc.Encode(inst.record(seq)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		f.Close()
+		return err
+	}
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f, s.w, s.enc, s.written = f, w, enc, 0
+	return nil
+}
+
+// record the state of instance seq, out of instances, and
+// force it to stable storage.
+func (s *store) save(seq int, inst *instance, instances map[int]*instance) error {
+	if s.f == nil {
+		return errClosed
+	}
+	if err := s.enc.Encode(inst.record(seq)); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	s.written++
+	if s.written > 2*len(instances)+100 {
+		return s.rewrite(instances)
+	}
+	return nil
+}
+
+func (s *store) close() {
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+}
+
+func (inst *instance) record(seq int) record {
+	return record{Seq: seq, Np: inst.np, Na: inst.na, Va: inst.va,
+		Decided: inst.decided, Decision: inst.decision}
+}
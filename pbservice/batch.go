@@ -0,0 +1,59 @@
+package pbservice
+
+import "time"
+
+//
+// Batches. A Batch op carries a list of ordinary ops and a list
+// of guards. The primary and every backup apply it as a single
+// op: if every guard holds, all of the ops are applied in
+// order, with nothing in between; otherwise none are.
+//
+
+// ops that may appear inside a Batch.
+func batchable(op Op) bool {
+	switch op {
+	case GET, PUT, APPEND, DELETE, CAS, PUTIFABSENT, PUTIFVERSION, INCREMENT:
+		return true
+	}
+	return false
+}
+
+func (g Guard) Holds(database map[string]string, versions map[string]int64) bool {
+	if g.CheckVersion {
+		return versions[g.Key] == g.Version
+	}
+	val, exists := database[g.Key]
+	return exists && val == g.Expected
+}
+
+// every key the op reads or writes.
+func (args OpArgs) Keys() []string {
+	if args.Op != BATCH {
+		return []string{args.Key}
+	}
+	keys := []string{}
+	for _, op := range args.Ops {
+		keys = append(keys, op.Key)
+	}
+	for _, guard := range args.Guards {
+		keys = append(keys, guard.Key)
+	}
+	return keys
+}
+
+// a copy of args with every TTL turned into an expiry time,
+// counting from now. an expiry the client sent is dropped.
+func (args OpArgs) Stamped(now time.Time) OpArgs {
+	args.Expires = 0
+	if args.TTL > 0 {
+		args.Expires = now.Add(args.TTL).UnixNano()
+	}
+	if args.Ops != nil {
+		ops := make([]OpArgs, len(args.Ops))
+		for i, op := range args.Ops {
+			ops[i] = op.Stamped(now)
+		}
+		args.Ops = ops
+	}
+	return args
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"umich.edu/eecs491/proj2/transport"
 	"umich.edu/eecs491/proj2/viewservice"
 )
 
@@ -34,13 +35,32 @@ func nameInitialize() {
 }
 
 type Clerk struct {
-	me      string
-	seqno   int
-	vs      *viewservice.Clerk
-	primary string
+	mu       sync.Mutex
+	me       string
+	seqno    int
+	vs       *viewservice.Clerk
+	primary  string
+	viewnum  uint          // view that primary came from
+	session  int           // which session we are in; 0 if none
+	sessions int           // how many sessions we have started
+	stop     chan struct{} // closed to stop the session's keepalives
+	pending  map[int]bool  // ops sent but not yet answered
+	window   chan struct{} // holds a token for each op in flight
+
+	registering sync.Mutex // held while starting a session
 }
 
+// how many ops a Clerk lets Go have in flight at once, unless
+// told otherwise with SetWindow.
+const DefaultWindow = 8
+
 func MakeClerk(vshost string, me string) *Clerk {
+	return MakeReplicatedClerk([]string{vshost}, me)
+}
+
+// a Clerk for a viewservice replicated across vshosts; it asks
+// whichever peer answers.
+func MakeReplicatedClerk(vshosts []string, me string) *Clerk {
 	nameInitialize()
 
 	ck := new(Clerk)
@@ -51,18 +71,53 @@ func MakeClerk(vshost string, me string) *Clerk {
 		ck.me = me
 	}
 	ck.seqno = 0
-	ck.vs = viewservice.MakeClerk(me, vshost)
+	ck.vs = viewservice.MakeReplicatedClerk(me, vshosts)
 	ck.primary = ""
+	ck.pending = make(map[int]bool)
+	ck.window = make(chan struct{}, DefaultWindow)
 
 	return ck
 }
 
+// let up to n ops be in flight at once. call before using the
+// Clerk.
+func (ck *Clerk) SetWindow(n int) {
+	if n < 1 {
+		n = 1
+	}
+	ck.window = make(chan struct{}, n)
+}
+
+// the ping interval advertised by the viewservice.
+func (ck *Clerk) pingInterval() time.Duration {
+	if interval, _, ok := ck.vs.Timing(); ok {
+		return interval
+	}
+	return viewservice.PingInterval
+}
+
+// find the primary. the current one is presumed gone, so wait
+// (briefly) for the viewservice to move past the view it came
+// from rather than polling; if the view does not change, the
+// same primary is tried again.
 func (ck *Clerk) refreshPrimary() {
 	run := true
 	for run {
-		time.Sleep(viewservice.PingInterval)
-		ck.primary = ck.vs.Primary()
+		ck.mu.Lock()
+		viewnum := ck.viewnum
+		ck.mu.Unlock()
+		v, ok := ck.vs.Watch(viewnum, ck.pingInterval())
+		if !ok {
+			time.Sleep(ck.pingInterval())
+			continue
+		}
+		ck.mu.Lock()
+		if v.Viewnum >= ck.viewnum {
+			ck.primary = v.Primary
+			ck.viewnum = v.Viewnum
+		}
 		run = (ck.primary == "")
+		ck.mu.Unlock()
 	}
 }
 
@@ -77,38 +132,191 @@ func (ck *Clerk) refreshPrimary() {
 // primary replies
 func (ck *Clerk) doOperation(op Op, key string,
 	value string, reply *OpReply) {
+	ck.doRequest(OpArgs{Op: op, Key: key, Value: value}, reply)
+}
 
-	// ask the viewservice for the primary if not already cached
-	if ck.primary == "" {
-		ck.refreshPrimary()
-	}
-
-	// Increment sequence number
-	ck.seqno = ck.seqno + 1
+// doOperation, for ops that need more of OpArgs filled in.
+// the Clerk supplies Client, SeqNo, Source, Session and Acked.
+func (ck *Clerk) doRequest(args OpArgs, reply *OpReply) {
+	c := <-ck.Go(args).Done
+	*reply = c.Reply
+}
 
-	// Create the argument/reply structs
-	args := OpArgs{Op: op, Key: key, Value: value,
-		Client: ck.me, SeqNo: ck.seqno, Source: ck.me}
+// An op started with Go.
+type Call struct {
+	Args  OpArgs
+	Reply OpReply    // valid once the Call has been sent on Done
+	Done  chan *Call // receives the Call when it completes
+}
 
-	for true {
-		// Issue until RPC succeeds
+// start an op without waiting for it to complete; Go blocks
+// only while the Clerk's window of ops in flight is full. ops
+// in flight together may be applied in any order, so wait for
+// one before starting another that depends on it.
+//
+// the op runs in a session, started first if the Clerk has
+// none. if the session has ended, a read, or an op that cannot
+// have run yet, is tried again in a new session; one that may
+// have run already fails with ErrSessionExpired.
+func (ck *Clerk) Go(args OpArgs) *Call {
+	c := &Call{Args: args, Done: make(chan *Call, 1)}
+	ck.window <- struct{}{}
+	go func() {
+		defer func() {
+			<-ck.window
+			c.Done <- c
+		}()
 		for {
-			ok := call(ck.primary, "PBServer.Operation", args, &reply)
-			if ok {
-				break
+			session := ck.register()
+			reply, sent := ck.send(c.Args)
+			c.Reply = reply
+			if reply.Err != ErrSessionExpired {
+				return
 			}
-			time.Sleep(viewservice.PingInterval)
+			ck.endSession(session)
+			if (sent && !readOnly(c.Args.Op)) || c.Args.Op == CLOSE {
+				log.Printf("%s: Session expired during %s of key %s\n", ck.me, c.Args.Op, c.Args.Key)
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// send an op under a new sequence number until some primary
+// answers it. also returns whether an earlier try may have been
+// applied.
+func (ck *Clerk) send(args OpArgs) (OpReply, bool) {
+	ck.mu.Lock()
+	ck.seqno = ck.seqno + 1
+	args.Client = ck.me
+	args.SeqNo = ck.seqno
+	args.Source = ck.me
+	args.Session = true
+	ck.pending[args.SeqNo] = true
+	ck.mu.Unlock()
+
+	sent := false
+	for {
+		ck.mu.Lock()
+		primary := ck.primary
+		args.Acked = ck.acked()
+		ck.mu.Unlock()
+		if primary == "" {
 			ck.refreshPrimary()
+			continue
 		}
 
-		if reply.Err == ErrWrongServer {
+		var reply OpReply
+		if !call(primary, "PBServer.Operation", args, &reply) || reply.Err == ErrWrongServer {
+			sent = true
 			ck.refreshPrimary()
-		} else {
+			continue
+		}
+		ck.mu.Lock()
+		delete(ck.pending, args.SeqNo)
+		ck.mu.Unlock()
+		return reply, sent
+	}
+}
+
+// the highest SeqNo up to which every op has been answered.
+// must be called with ck.mu held.
+func (ck *Clerk) acked() int {
+	acked := ck.seqno
+	for seqno := range ck.pending {
+		if seqno <= acked {
+			acked = seqno - 1
+		}
+	}
+	return acked
+}
+
+// start a session, unless we are in one already, and keep it
+// alive until it is closed. returns which session we are in.
+func (ck *Clerk) register() int {
+	ck.registering.Lock()
+	defer ck.registering.Unlock()
+	ck.mu.Lock()
+	session := ck.session
+	ck.mu.Unlock()
+	if session != 0 {
+		return session
+	}
+
+	log.Printf("%s: Registering session\n", ck.me)
+	reply, _ := ck.send(OpArgs{Op: REGISTER})
+	stop := make(chan struct{})
+	go ck.keepAlive(reply.SessionTimeout, stop)
+
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.sessions++
+	ck.session = ck.sessions
+	ck.stop = stop
+	return ck.session
+}
+
+// send KeepAlives often enough that the session doesn't time
+// out, until stop is closed or the session ends anyway.
+func (ck *Clerk) keepAlive(timeout time.Duration, stop chan struct{}) {
+	if timeout <= 0 {
+		timeout = DefaultSessionTimeout
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(timeout / 3):
+		}
+		args := OpArgs{Op: KEEPALIVE, Client: ck.me, Source: ck.me, Session: true}
+		var reply OpReply
+		primary := ck.vs.Primary()
+		if primary != "" && call(primary, "PBServer.Operation", args, &reply) &&
+			reply.Err == ErrSessionExpired {
 			return
 		}
 	}
 }
 
+// note that session has ended, if it is still the current one.
+func (ck *Clerk) endSession(session int) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if ck.session != session {
+		return
+	}
+	if ck.stop != nil {
+		close(ck.stop)
+		ck.stop = nil
+	}
+	ck.session = 0
+}
+
+// end the Clerk's session, once every op in flight is done, so
+// the servers can forget about it. if the Clerk is used again,
+// it starts a new one.
+func (ck *Clerk) Close() {
+	for i := 0; i < cap(ck.window); i++ {
+		ck.window <- struct{}{}
+	}
+	for i := 0; i < cap(ck.window); i++ {
+		<-ck.window
+	}
+	ck.mu.Lock()
+	session := ck.session
+	ck.mu.Unlock()
+	if session == 0 {
+		return
+	}
+
+	var reply OpReply
+
+	log.Printf("%s: Closing session\n", ck.me)
+	ck.doRequest(OpArgs{Op: CLOSE}, &reply)
+	ck.endSession(session)
+}
+
 // Get a value for a key
 func (ck *Clerk) Get(key string) string {
 
@@ -124,22 +332,242 @@ func (ck *Clerk) Get(key string) string {
 	}
 }
 
-// tell the primary to update key's value.
-func (ck *Clerk) Put(key string, value string) {
+// Get a value for a key, along with its version. a missing key
+// has version 0.
+func (ck *Clerk) GetVersion(key string) (string, int64) {
+
+	var reply OpReply
+
+	log.Printf("%s: Getting value and version for key %s\n", ck.me, key)
+	ck.doOperation(GET, key, "", &reply)
+	return reply.Value, reply.Version
+}
+
+// tell the primary to update key's value. returns OK, or
+// ErrSessionExpired if the Clerk's session ended while the Put
+// was in flight, in which case it may or may not have been
+// applied. the other writes below fail the same way.
+func (ck *Clerk) Put(key string, value string) Err {
 
 	var reply OpReply
 
 	log.Printf("%s: Putting value %s for key %s\n", ck.me, value, key)
 	ck.doOperation(PUT, key, value, &reply)
+	return reply.Err
 }
 
 // tell the primary to append to key's value.
-func (ck *Clerk) Append(key string, value string) {
+func (ck *Clerk) Append(key string, value string) Err {
 
 	var reply OpReply
 
 	log.Printf("%s: Appending value %s to key %s\n", ck.me, value, key)
 	ck.doOperation(APPEND, key, value, &reply)
+	return reply.Err
+}
+
+// Put, but key expires (and reads as missing) once ttl has
+// passed, unless it is written again first.
+func (ck *Clerk) PutTTL(key string, value string, ttl time.Duration) Err {
+
+	var reply OpReply
+
+	log.Printf("%s: Putting value %s for key %s for %v\n", ck.me, value, key, ttl)
+	ck.doRequest(OpArgs{Op: PUT, Key: key, Value: value, TTL: ttl}, &reply)
+	return reply.Err
+}
+
+// Append, and have key expire once ttl has passed.
+func (ck *Clerk) AppendTTL(key string, value string, ttl time.Duration) Err {
+
+	var reply OpReply
+
+	log.Printf("%s: Appending value %s to key %s for %v\n", ck.me, value, key, ttl)
+	ck.doRequest(OpArgs{Op: APPEND, Key: key, Value: value, TTL: ttl}, &reply)
+	return reply.Err
+}
+
+// tell the primary to remove key.
+func (ck *Clerk) Delete(key string) Err {
+
+	var reply OpReply
+
+	log.Printf("%s: Deleting key %s\n", ck.me, key)
+	ck.doOperation(DELETE, key, "", &reply)
+	return reply.Err
+}
+
+// add delta to key's value, taken as a signed 64-bit integer
+// (0 if key doesn't exist), and return the new value. fails
+// with ErrNotNumeric or ErrOverflow, leaving the key alone, or
+// with ErrSessionExpired as Put does.
+func (ck *Clerk) Increment(key string, delta int64) (int64, Err) {
+
+	var reply OpReply
+
+	log.Printf("%s: Incrementing key %s by %v\n", ck.me, key, delta)
+	ck.doRequest(OpArgs{Op: INCREMENT, Key: key, Delta: delta}, &reply)
+	if reply.Err != OK {
+		return 0, reply.Err
+	}
+	n, _ := strconv.ParseInt(reply.Value, 10, 64)
+	return n, OK
+}
+
+// set key to value if its current value is expected. returns
+// whether it did, the value key had before, and an Err as Put
+// does; so do the conditional writes below.
+func (ck *Clerk) CompareAndSwap(key string, expected string, value string) (bool, string, Err) {
+
+	var reply OpReply
+
+	log.Printf("%s: Swapping value %s for %s at key %s\n", ck.me, value, expected, key)
+	ck.doRequest(OpArgs{Op: CAS, Key: key, Expected: expected, Value: value}, &reply)
+	return reply.Applied, reply.Value, reply.Err
+}
+
+// set key to value if key does not exist yet. returns whether
+// it did, and otherwise the value key already has.
+func (ck *Clerk) PutIfAbsent(key string, value string) (bool, string, Err) {
+
+	var reply OpReply
+
+	log.Printf("%s: Putting value %s for absent key %s\n", ck.me, value, key)
+	ck.doRequest(OpArgs{Op: PUTIFABSENT, Key: key, Value: value}, &reply)
+	return reply.Applied, reply.Value, reply.Err
+}
+
+// set key to value if key is at the given version (0 meaning
+// it doesn't exist). returns whether it did, and the key's
+// version afterwards.
+func (ck *Clerk) PutIfVersion(key string, value string, version int64) (bool, int64, Err) {
+
+	var reply OpReply
+
+	log.Printf("%s: Putting value %s for key %s at version %v\n", ck.me, value, key, version)
+	ck.doRequest(OpArgs{Op: PUTIFVERSION, Key: key, Value: value, Version: version}, &reply)
+	return reply.Applied, reply.Version, reply.Err
+}
+
+// apply ops atomically, provided every guard holds. each op
+// needs only its Op, Key and the fields that op uses. returns
+// whether the batch was applied, and if so each op's result,
+// along with an Err as Put returns.
+func (ck *Clerk) Batch(ops []OpArgs, guards []Guard) (bool, []OpReply, Err) {
+
+	var reply OpReply
+
+	log.Printf("%s: Batch of %v ops with %v guards\n", ck.me, len(ops), len(guards))
+	ck.doRequest(OpArgs{Op: BATCH, Ops: ops, Guards: guards}, &reply)
+	return reply.Applied, reply.Results, reply.Err
+}
+
+// up to limit keys in [start, end), in order, with their
+// values and versions; end == "" means no upper bound. if
+// there are more, cursor is the start of the next page;
+// otherwise it is "".
+func (ck *Clerk) Scan(start string, end string, limit int) ([]KeyValue, string) {
+
+	var reply OpReply
+
+	log.Printf("%s: Scanning keys from %s to %s\n", ck.me, start, end)
+	ck.doRequest(OpArgs{Op: SCAN, Key: start, End: end, Limit: limit}, &reply)
+	return reply.Entries, reply.Cursor
+}
+
+// every key that starts with prefix, in order, fetched a page
+// at a time.
+func (ck *Clerk) ListPrefix(prefix string) []KeyValue {
+	entries := []KeyValue{}
+	end := prefixEnd(prefix)
+	for cursor := prefix; ; {
+		page, next := ck.Scan(cursor, end, DefaultScanLimit)
+		entries = append(entries, page...)
+		if next == "" {
+			return entries
+		}
+		cursor = next
+	}
+}
+
+// deliver every change to key made after revision after (or
+// from now on, if after < 0) on the returned channel, until
+// stop is called. with prefix, changes to every key starting
+// with key are delivered. the stream follows the primary
+// across failovers without losing changes; it is closed early
+// only if it falls too far behind.
+func (ck *Clerk) Watch(key string, prefix bool, after int64) (<-chan Event, func()) {
+	stream := make(chan Event)
+	done := make(chan struct{})
+	ck.mu.Lock()
+	primary := ck.primary
+	ck.mu.Unlock()
+	if after < 0 {
+		// settle where the stream starts before returning, so
+		// that a failover can't lose the changes made meanwhile.
+		after, primary = ck.revision(primary)
+	}
+	go func() {
+		defer close(stream)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if primary == "" {
+				primary = ck.vs.Primary()
+				if primary == "" {
+					time.Sleep(ck.pingInterval())
+					continue
+				}
+			}
+
+			args := WatchArgs{Key: key, Prefix: prefix, AfterRevision: after,
+				Timeout: time.Second}
+			var reply WatchReply
+			ok := call(primary, "PBServer.Watch", args, &reply)
+			if !ok || reply.Err == ErrWrongServer {
+				primary = ""
+				time.Sleep(ck.pingInterval())
+				continue
+			}
+			if reply.Err == ErrCompacted {
+				log.Printf("%s: Watch of %s fell behind at revision %v\n", ck.me, key, after)
+				return
+			}
+			for _, e := range reply.Events {
+				select {
+				case stream <- e:
+				case <-done:
+					return
+				}
+			}
+			after = reply.Revision
+		}
+	}()
+	var once sync.Once
+	stop := func() { once.Do(func() { close(done) }) }
+	return stream, stop
+}
+
+// the primary's current revision, asking primary first. also
+// returns the primary that answered.
+func (ck *Clerk) revision(primary string) (int64, string) {
+	for {
+		if primary == "" {
+			primary = ck.vs.Primary()
+		}
+		if primary != "" {
+			args := WatchArgs{AfterRevision: -1, Timeout: -1}
+			var reply WatchReply
+			if call(primary, "PBServer.Watch", args, &reply) && reply.Err == OK {
+				return reply.Revision, primary
+			}
+		}
+		primary = ""
+		time.Sleep(ck.pingInterval())
+	}
 }
 
 // call() sends an RPC to the rpcname handler on server srv
@@ -156,10 +584,11 @@ func (ck *Clerk) Append(key string, value string) {
 // don't provide your own time-out mechanism.
 func call(srv string, rpcname string,
 	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
+	conn, errx := transport.Dial(srv)
 	if errx != nil {
 		return false
 	}
+	c := rpc.NewClient(conn)
 	defer c.Close()
 
 	err := c.Call(rpcname, args, reply)
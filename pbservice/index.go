@@ -0,0 +1,71 @@
+package pbservice
+
+import "sort"
+
+//
+// An ordered index of the keys in the database, for Scan. It
+// is kept up to date by every write and delete, and rebuilt
+// from scratch when a backup receives a Push.
+//
+
+// default and largest number of keys one Scan returns.
+const (
+	DefaultScanLimit = 100
+	MaxScanLimit     = 1000
+)
+
+type keyIndex struct {
+	keys []string // sorted
+}
+
+func (ix *keyIndex) insert(key string) {
+	i := sort.SearchStrings(ix.keys, key)
+	if i < len(ix.keys) && ix.keys[i] == key {
+		return
+	}
+	ix.keys = append(ix.keys, "")
+	copy(ix.keys[i+1:], ix.keys[i:])
+	ix.keys[i] = key
+}
+
+func (ix *keyIndex) remove(key string) {
+	i := sort.SearchStrings(ix.keys, key)
+	if i < len(ix.keys) && ix.keys[i] == key {
+		ix.keys = append(ix.keys[:i], ix.keys[i+1:]...)
+	}
+}
+
+func (ix *keyIndex) rebuild(database map[string]string) {
+	ix.keys = make([]string, 0, len(database))
+	for key := range database {
+		ix.keys = append(ix.keys, key)
+	}
+	sort.Strings(ix.keys)
+}
+
+// up to limit keys in [start, end), in order; end == "" means
+// no upper bound. cursor is where the next page starts, or ""
+// if there is none.
+func (ix *keyIndex) scan(start string, end string, limit int) (keys []string, cursor string) {
+	i := sort.SearchStrings(ix.keys, start)
+	for ; i < len(ix.keys) && (end == "" || ix.keys[i] < end); i++ {
+		if len(keys) == limit {
+			return keys, ix.keys[i]
+		}
+		keys = append(keys, ix.keys[i])
+	}
+	return keys, ""
+}
+
+// the smallest key greater than every key starting with
+// prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
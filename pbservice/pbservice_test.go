@@ -7,7 +7,9 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -1211,3 +1213,1849 @@ func TestRepeatedCrashUnreliable(t *testing.T) {
 	vs.Kill(vsterm)
 	time.Sleep(time.Second)
 }
+
+// two backups: the data survives two primary failures.
+func TestTwoBackups(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "twob"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServerWithConfig(vshost, viewservice.Config{Backups: 2}, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Two backups survive two primary failures ...\n")
+
+	const nservers = 3
+	var sa [nservers]*PBServer
+	var st [nservers]chan interface{}
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServer(vshost, port(tag, i+1), st[i])
+		time.Sleep(2 * viewservice.PingInterval)
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := vck.Get()
+		if view.Primary != "" && len(view.Backups) == 2 {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	view1, _ := vck.Get()
+	if len(view1.Backups) != 2 || view1.Backup != view1.Backups[0] {
+		t.Fatalf("wanted two backups, got %v", view1)
+	}
+
+	// give p+b time to ack, initialize
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", "1")
+	ck.Append("a", "2")
+	ck.Put("b", "3")
+
+	byName := func(me string) int {
+		for i := 0; i < nservers; i++ {
+			if sa[i].me == me {
+				return i
+			}
+		}
+		t.Fatalf("unknown server %v", me)
+		return -1
+	}
+
+	for round := 0; round < 2; round++ {
+		// let the primary ack the current view, so that the
+		// viewservice is free to replace it, and only then see
+		// which backup should take over; the view may have moved
+		// on since the last round checked it.
+		time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+		prev, _ := vck.Get()
+		if len(prev.Backups) != 2-round {
+			t.Fatalf("round %v: wanted %v backups, got %v", round, 2-round, prev)
+		}
+		i := byName(prev.Primary)
+		sa[i].kill(st[i])
+		for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+			view, _ := vck.Get()
+			if view.Primary == prev.Backups[0] {
+				break
+			}
+			time.Sleep(viewservice.PingInterval)
+		}
+		view, _ := vck.Get()
+		if view.Primary != prev.Backups[0] {
+			t.Fatalf("first backup was not promoted; view %v", view)
+		}
+		check(t, ck, "a", "12")
+		check(t, ck, "b", "3")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		if !sa[i].isdead() {
+			sa[i].kill(st[i])
+		}
+	}
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+	time.Sleep(time.Second)
+}
+
+// a tcp:// address on a free local port.
+func tcpPort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("no free port: %v", err)
+	}
+	defer l.Close()
+	return "tcp://" + l.Addr().String()
+}
+
+func TestAtMostOnceTCP(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	vshost := tcpPort(t)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServer(vshost, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: at-most-once Append over TCP; unreliable ...\n")
+
+	const nservers = 2
+	var st [nservers]chan interface{}
+	var sa [nservers]*PBServer
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServer(vshost, tcpPort(t), st[i])
+		sa[i].setunreliable(true)
+	}
+
+	for iters := 0; iters < viewservice.DeadPings*2; iters++ {
+		view, _ := vck.Get()
+		if view.Primary != "" && view.Backup != "" {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+
+	// give p+b time to ack, initialize
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+	ck := MakeClerk(vshost, "")
+	k := "counter"
+	val := ""
+	for i := 0; i < 50; i++ {
+		v := strconv.Itoa(i)
+		ck.Append(k, v)
+		val = val + v
+	}
+
+	v := ck.Get(k)
+	if v != val {
+		t.Fatalf("ck.Get() returned %v but expected %v\n", v, val)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		sa[i].kill(st[i])
+	}
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+	time.Sleep(time.Second)
+}
+
+// p/b servers must ping as often as the viewservice asks,
+// or they would be declared dead over and over.
+func TestAdvertisedTiming(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const interval = 25 * time.Millisecond
+
+	tag := "timing"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	vs := viewservice.StartServerWithConfig(vshost,
+		viewservice.Config{PingInterval: interval, DeadPings: 3}, vsterm)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	fmt.Printf("Test: Servers adopt the viewservice's ping interval ...\n")
+
+	const nservers = 2
+	var sa [nservers]*PBServer
+	var st [nservers]chan interface{}
+	for i := 0; i < nservers; i++ {
+		st[i] = make(chan interface{})
+		sa[i] = StartServer(vshost, port(tag, i+1), st[i])
+	}
+
+	for iters := 0; iters < 100; iters++ {
+		view, _ := vck.Get()
+		if view.Primary != "" && view.Backup != "" {
+			break
+		}
+		time.Sleep(interval)
+	}
+	time.Sleep(10 * interval)
+
+	view1, _ := vck.Get()
+	if view1.Primary == "" || view1.Backup == "" {
+		t.Fatalf("no primary and backup: %v", view1)
+	}
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", "x")
+	time.Sleep(time.Second)
+	check(t, ck, "a", "x")
+
+	view2, _ := vck.Get()
+	if view2.Viewnum != view1.Viewnum {
+		t.Fatalf("view changed from %v to %v; servers are pinging too slowly", view1, view2)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < nservers; i++ {
+		sa[i].kill(st[i])
+	}
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+	time.Sleep(time.Second)
+}
+
+// a viewserver and some PBServers, for tests that only need a
+// working primary and backup.
+type cluster struct {
+	vs     *viewservice.ViewServer
+	vsterm chan interface{}
+	vshost string
+	vck    *viewservice.Clerk
+	sa     []*PBServer
+	st     []chan interface{}
+}
+
+func startCluster(t *testing.T, tag string, nservers int) *cluster {
+	return startClusterWithConfig(t, tag, make([]Config, nservers))
+}
+
+// startCluster, with a server started with each of cfgs.
+func startClusterWithConfig(t *testing.T, tag string, cfgs []Config) *cluster {
+	return startClusterWithVS(t, tag, viewservice.Config{}, cfgs)
+}
+
+// startClusterWithConfig, with the viewservice started with vscfg.
+func startClusterWithVS(t *testing.T, tag string, vscfg viewservice.Config, cfgs []Config) *cluster {
+	nservers := len(cfgs)
+	c := &cluster{}
+	c.vshost = port(tag+"v", 1)
+	c.vsterm = make(chan interface{})
+	c.vs = viewservice.StartServerWithConfig(c.vshost, vscfg, c.vsterm)
+	time.Sleep(time.Second)
+	c.vck = viewservice.MakeClerk("", c.vshost)
+
+	for i := 0; i < nservers; i++ {
+		c.st = append(c.st, make(chan interface{}))
+		c.sa = append(c.sa, StartServerWithConfig(c.vshost, port(tag, i+1), cfgs[i], c.st[i]))
+	}
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		view, _ := c.vck.Get()
+		if view.Primary != "" && (nservers < 2 || view.Backup != "") {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	view, _ := c.vck.Get()
+	if view.Primary == "" || (nservers >= 2 && view.Backup == "") {
+		t.Fatalf("no primary/backup: %v", view)
+	}
+	// give p+b time to ack, initialize
+	time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+	return c
+}
+
+// kill the primary, and wait for the backup to take over.
+func (c *cluster) killPrimary(t *testing.T) {
+	view, _ := c.vck.Get()
+	for i := range c.sa {
+		if c.sa[i].me == view.Primary {
+			c.sa[i].kill(c.st[i])
+		}
+	}
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		v, _ := c.vck.Get()
+		if v.Primary == view.Backup {
+			break
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	if v, _ := c.vck.Get(); v.Primary != view.Backup {
+		t.Fatalf("backup never took over; view %v", v)
+	}
+}
+
+// kill the backup, and wait for the viewservice to drop it.
+// returns its index in c.sa.
+func (c *cluster) killBackup(t *testing.T) int {
+	view, _ := c.vck.Get()
+	b := -1
+	for i := range c.sa {
+		if c.sa[i].me == view.Backup {
+			b = i
+			c.sa[i].kill(c.st[i])
+		}
+	}
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		if v, _ := c.vck.Get(); v.Backup != view.Backup {
+			return b
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	t.Fatalf("backup never dropped from view %v", view)
+	return b
+}
+
+// restart server i with cfg, and wait for it to become the backup.
+func (c *cluster) restart(t *testing.T, i int, tag string, cfg Config) {
+	c.st[i] = make(chan interface{})
+	c.sa[i] = StartServerWithConfig(c.vshost, port(tag, i+1), cfg, c.st[i])
+	for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+		if v, _ := c.vck.Get(); v.Backup == c.sa[i].me {
+			return
+		}
+		time.Sleep(viewservice.PingInterval)
+	}
+	t.Fatalf("%v never became the backup", c.sa[i].me)
+}
+
+func (c *cluster) kill() {
+	for i := range c.sa {
+		if !c.sa[i].isdead() {
+			c.sa[i].kill(c.st[i])
+		}
+	}
+	time.Sleep(time.Second)
+	c.vs.Kill(c.vsterm)
+	time.Sleep(time.Second)
+}
+
+func TestDelete(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	c := startCluster(t, "delete", 2)
+	ck := MakeClerk(c.vshost, "")
+
+	fmt.Printf("Test: Get of a deleted key returns ErrNoKey ...\n")
+
+	{
+		var reply OpReply
+		ck.doOperation(GET, "a", "", &reply)
+		if reply.Err != ErrNoKey {
+			t.Fatalf("Get of a missing key -> %v", reply.Err)
+		}
+
+		ck.Put("a", "1")
+		ck.Put("b", "2")
+		check(t, ck, "a", "1")
+		ck.Delete("a")
+		ck.doOperation(GET, "a", "", &reply)
+		if reply.Err != ErrNoKey || reply.Value != "" {
+			t.Fatalf("Get of a deleted key -> %v %q", reply.Err, reply.Value)
+		}
+		check(t, ck, "b", "2")
+
+		// deleting again is harmless.
+		ck.Delete("a")
+		ck.Append("a", "x")
+		check(t, ck, "a", "x")
+		ck.Delete("a")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Deletes reach the backup ...\n")
+
+	{
+		c.killPrimary(t)
+		var reply OpReply
+		ck.doOperation(GET, "a", "", &reply)
+		if reply.Err != ErrNoKey {
+			t.Fatalf("Get from new primary -> %v %q", reply.Err, reply.Value)
+		}
+		check(t, ck, "b", "2")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	c.kill()
+}
+
+func TestConditionalWrites(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	c := startCluster(t, "cas", 2)
+	ck := MakeClerk(c.vshost, "")
+
+	fmt.Printf("Test: CompareAndSwap and PutIfAbsent ...\n")
+
+	{
+		if ok, _, _ := ck.CompareAndSwap("a", "", "1"); ok {
+			t.Fatalf("CompareAndSwap of a missing key succeeded")
+		}
+		if ok, _, _ := ck.PutIfAbsent("a", "1"); !ok {
+			t.Fatalf("PutIfAbsent of a missing key failed")
+		}
+		if ok, old, _ := ck.PutIfAbsent("a", "2"); ok || old != "1" {
+			t.Fatalf("PutIfAbsent of an existing key -> %v, %q", ok, old)
+		}
+		if ok, old, _ := ck.CompareAndSwap("a", "0", "2"); ok || old != "1" {
+			t.Fatalf("CompareAndSwap with the wrong value -> %v, %q", ok, old)
+		}
+		check(t, ck, "a", "1")
+		if ok, old, _ := ck.CompareAndSwap("a", "1", "2"); !ok || old != "1" {
+			t.Fatalf("CompareAndSwap with the right value -> %v, %q", ok, old)
+		}
+		check(t, ck, "a", "2")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: A retried CompareAndSwap gets its first outcome ...\n")
+
+	{
+		args := OpArgs{Op: CAS, Key: "a", Expected: "2", Value: "3",
+			Client: "cas-client", SeqNo: 1, Source: "cas-client"}
+		for i := 0; i < 2; i++ {
+			var reply OpReply
+			if !call(c.vck.Primary(), "PBServer.Operation", args, &reply) {
+				t.Fatalf("Operation RPC failed")
+			}
+			if reply.Err != OK || !reply.Applied || reply.Value != "2" {
+				t.Fatalf("attempt %v -> %v", i, reply)
+			}
+		}
+		check(t, ck, "a", "3")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Conditional writes reach the backup ...\n")
+
+	{
+		ck.PutIfAbsent("b", "x")
+		ck.CompareAndSwap("b", "x", "y")
+		c.killPrimary(t)
+		check(t, ck, "a", "3")
+		check(t, ck, "b", "y")
+		if ok, _, _ := ck.CompareAndSwap("b", "y", "z"); !ok {
+			t.Fatalf("CompareAndSwap on the new primary failed")
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	c.kill()
+}
+
+func TestVersions(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	c := startCluster(t, "version", 3)
+	ck := MakeClerk(c.vshost, "")
+
+	fmt.Printf("Test: Every write raises the key's version ...\n")
+
+	var last int64
+	{
+		if _, v := ck.GetVersion("a"); v != 0 {
+			t.Fatalf("missing key has version %v", v)
+		}
+		ck.Put("a", "1")
+		_, v1 := ck.GetVersion("a")
+		ck.Append("a", "2")
+		val, v2 := ck.GetVersion("a")
+		if v1 <= 0 || v2 <= v1 || val != "12" {
+			t.Fatalf("versions %v then %v, value %q", v1, v2, val)
+		}
+		ck.Delete("a")
+		ck.Put("a", "3")
+		_, v3 := ck.GetVersion("a")
+		if v3 <= v2 {
+			t.Fatalf("re-created key went from version %v to %v", v2, v3)
+		}
+		last = v3
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: PutIfVersion ...\n")
+
+	{
+		if ok, v, _ := ck.PutIfVersion("a", "x", last-1); ok || v != last {
+			t.Fatalf("PutIfVersion with a stale version -> %v, %v", ok, v)
+		}
+		check(t, ck, "a", "3")
+		ok, v, _ := ck.PutIfVersion("a", "x", last)
+		if !ok || v <= last {
+			t.Fatalf("PutIfVersion with the current version -> %v, %v", ok, v)
+		}
+		last = v
+		if ok, _, _ := ck.PutIfVersion("b", "y", 0); !ok {
+			t.Fatalf("PutIfVersion(0) of a missing key failed")
+		}
+		if ok, _, _ := ck.PutIfVersion("b", "z", 0); ok {
+			t.Fatalf("PutIfVersion(0) of an existing key succeeded")
+		}
+		check(t, ck, "a", "x")
+		check(t, ck, "b", "y")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Versions survive failover ...\n")
+
+	{
+		_, vb := ck.GetVersion("b")
+		// the third server only gets the versions by Push.
+		c.killPrimary(t)
+		time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+		c.killPrimary(t)
+		if val, v := ck.GetVersion("a"); val != "x" || v != last {
+			t.Fatalf("after failover a is %q at %v; wanted x at %v", val, v, last)
+		}
+		if _, v := ck.GetVersion("b"); v != vb {
+			t.Fatalf("after failover b is at %v; wanted %v", v, vb)
+		}
+		ck.Put("c", "1")
+		if _, v := ck.GetVersion("c"); v <= vb {
+			t.Fatalf("new primary reused version %v", v)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	c.kill()
+}
+
+func TestTTL(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	c := startCluster(t, "ttl", 2)
+	ck := MakeClerk(c.vshost, "")
+
+	const ttl = 300 * time.Millisecond
+
+	fmt.Printf("Test: Keys expire after their TTL ...\n")
+
+	{
+		ck.PutTTL("a", "x", ttl)
+		ck.Put("b", "y")
+		ck.PutTTL("b", "y", ttl)
+		ck.Put("b", "z") // no TTL any more
+		ck.PutTTL("c", "1", ttl)
+		ck.Append("c", "2") // keeps the TTL
+		check(t, ck, "a", "x")
+		check(t, ck, "c", "12")
+
+		time.Sleep(2 * ttl)
+		var reply OpReply
+		ck.doOperation(GET, "a", "", &reply)
+		if reply.Err != ErrNoKey {
+			t.Fatalf("expired key -> %v %q", reply.Err, reply.Value)
+		}
+		check(t, ck, "b", "z")
+		check(t, ck, "c", "")
+		if ok, _, _ := ck.PutIfAbsent("a", "new"); !ok {
+			t.Fatalf("PutIfAbsent of an expired key failed")
+		}
+		check(t, ck, "a", "new")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Only the primary sets when a key expires ...\n")
+
+	{
+		soon := time.Now().Add(ttl).UnixNano()
+		var reply OpReply
+		ck.doRequest(OpArgs{Op: PUT, Key: "f", Value: "1", Expires: soon}, &reply)
+		ck.doRequest(OpArgs{Op: BATCH, Ops: []OpArgs{
+			{Op: PUT, Key: "g", Value: "2", Expires: soon}}}, &reply)
+		time.Sleep(2 * ttl)
+		check(t, ck, "f", "1")
+		check(t, ck, "g", "2")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Expiry is replicated to the backup ...\n")
+
+	{
+		ck.PutTTL("d", "x", ttl)
+		// nobody reads d; the primary expires it on its own.
+		time.Sleep(2*ttl + 2*viewservice.PingInterval)
+		ck.Put("e", "1")
+		_, ve := ck.GetVersion("e")
+
+		c.killPrimary(t)
+		var reply OpReply
+		ck.doOperation(GET, "d", "", &reply)
+		if reply.Err != ErrNoKey {
+			t.Fatalf("expired key on new primary -> %v %q", reply.Err, reply.Value)
+		}
+		if _, v := ck.GetVersion("e"); v != ve {
+			t.Fatalf("new primary has e at version %v, old had %v", v, ve)
+		}
+		check(t, ck, "a", "new")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	c.kill()
+}
+
+func TestBatch(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	c := startCluster(t, "batch", 2)
+	ck := MakeClerk(c.vshost, "")
+
+	fmt.Printf("Test: Batch applies every op and returns each result ...\n")
+
+	{
+		ok, results, _ := ck.Batch([]OpArgs{
+			{Op: PUT, Key: "a", Value: "1"},
+			{Op: PUT, Key: "b", Value: "2"},
+			{Op: APPEND, Key: "a", Value: "x"},
+			{Op: GET, Key: "a"},
+			{Op: GET, Key: "missing"},
+		}, nil)
+		if !ok || len(results) != 5 {
+			t.Fatalf("Batch -> %v, %v", ok, results)
+		}
+		if results[3].Value != "1x" || results[4].Err != ErrNoKey {
+			t.Fatalf("Batch results %v", results)
+		}
+		check(t, ck, "a", "1x")
+		check(t, ck, "b", "2")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: A failed guard aborts the whole batch ...\n")
+
+	{
+		ops := []OpArgs{{Op: PUT, Key: "a", Value: "new"}, {Op: DELETE, Key: "b"}}
+		if ok, _, _ := ck.Batch(ops, []Guard{{Key: "b", Expected: "2"}, {Key: "a", Expected: "1"}}); ok {
+			t.Fatalf("Batch with a failing guard was applied")
+		}
+		check(t, ck, "a", "1x")
+		check(t, ck, "b", "2")
+
+		_, va := ck.GetVersion("a")
+		if ok, _, _ := ck.Batch(ops, []Guard{{Key: "a", Version: va, CheckVersion: true}}); !ok {
+			t.Fatalf("Batch with a holding version guard was not applied")
+		}
+		check(t, ck, "a", "new")
+		check(t, ck, "b", "")
+
+		// a version-0 guard requires the key to be missing.
+		create := []OpArgs{{Op: PUT, Key: "c", Value: "1"}}
+		absent := []Guard{{Key: "c", CheckVersion: true}}
+		if ok, _, _ := ck.Batch(create, absent); !ok {
+			t.Fatalf("Batch guarded on a missing key was not applied")
+		}
+		if ok, _, _ := ck.Batch(create, absent); ok {
+			t.Fatalf("Batch guarded on a missing key was applied twice")
+		}
+
+		nested := []OpArgs{{Op: PUT, Key: "d", Value: "1"}, {Op: BATCH}}
+		if ok, _, _ := ck.Batch(nested, nil); ok {
+			t.Fatalf("nested Batch was applied")
+		}
+		check(t, ck, "d", "")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Concurrent batches are atomic ...\n")
+
+	{
+		const nclients = 3
+		const nbatches = 20
+		var done sync.WaitGroup
+		for i := 0; i < nclients; i++ {
+			done.Add(1)
+			go func(i int) {
+				defer done.Done()
+				ck := MakeClerk(c.vshost, "")
+				for j := 0; j < nbatches; j++ {
+					v := strconv.Itoa(i*1000 + j)
+					ck.Batch([]OpArgs{{Op: PUT, Key: "x", Value: v}, {Op: PUT, Key: "y", Value: v}}, nil)
+				}
+			}(i)
+		}
+		for j := 0; j < nbatches; j++ {
+			_, results, _ := ck.Batch([]OpArgs{{Op: GET, Key: "x"}, {Op: GET, Key: "y"}}, nil)
+			if results[0].Value != results[1].Value {
+				t.Fatalf("saw x=%v y=%v", results[0].Value, results[1].Value)
+			}
+		}
+		done.Wait()
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Batches reach the backup ...\n")
+
+	{
+		x := ck.Get("x")
+		c.killPrimary(t)
+		check(t, ck, "a", "new")
+		check(t, ck, "b", "")
+		check(t, ck, "c", "1")
+		check(t, ck, "x", x)
+		check(t, ck, "y", x)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	c.kill()
+}
+
+func TestScan(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	c := startCluster(t, "scan", 3)
+	ck := MakeClerk(c.vshost, "")
+
+	keysOf := func(entries []KeyValue) string {
+		keys := []string{}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		return strings.Join(keys, " ")
+	}
+
+	fmt.Printf("Test: Scan and ListPrefix ...\n")
+
+	{
+		for _, key := range []string{"user/2/a", "user/1/b", "other", "user/12/x", "user/1/a", "user/1/c"} {
+			ck.Put(key, "v-"+key)
+		}
+		ck.Delete("user/1/c")
+
+		entries := ck.ListPrefix("user/1/")
+		if keysOf(entries) != "user/1/a user/1/b" {
+			t.Fatalf("ListPrefix(user/1/) -> %v", keysOf(entries))
+		}
+		if entries[0].Value != "v-user/1/a" || entries[0].Version == 0 {
+			t.Fatalf("ListPrefix entry %v", entries[0])
+		}
+
+		page, cursor := ck.Scan("user/", "", 2)
+		if keysOf(page) != "user/1/a user/1/b" || cursor != "user/12/x" {
+			t.Fatalf("first page %v, cursor %q", keysOf(page), cursor)
+		}
+		page, cursor = ck.Scan(cursor, "", 2)
+		if keysOf(page) != "user/12/x user/2/a" || cursor != "" {
+			t.Fatalf("second page %v, cursor %q", keysOf(page), cursor)
+		}
+		page, _ = ck.Scan("a", "user/", 10)
+		if keysOf(page) != "other" {
+			t.Fatalf("bounded scan -> %v", keysOf(page))
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Pushed backups rebuild the index ...\n")
+
+	{
+		c.killPrimary(t)
+		time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+		ck.Put("user/1/d", "v")
+		c.killPrimary(t)
+		entries := ck.ListPrefix("user/")
+		if keysOf(entries) != "user/1/a user/1/b user/1/d user/12/x user/2/a" {
+			t.Fatalf("after failover, ListPrefix(user/) -> %v", keysOf(entries))
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	c.kill()
+}
+
+func TestWatchKeys(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	c := startCluster(t, "watch", 2)
+	ck := MakeClerk(c.vshost, "")
+	ck.Put("warmup", "x")
+
+	next := func(stream <-chan Event) Event {
+		select {
+		case e, ok := <-stream:
+			if !ok {
+				t.Fatalf("watch stream closed")
+			}
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event")
+		}
+		return Event{}
+	}
+	expect := func(e Event, op Op, key string, value string) {
+		if e.Op != op || e.Key != key || e.Value != value {
+			t.Fatalf("got event %v, wanted %v %v=%q", e, op, key, value)
+		}
+	}
+
+	fmt.Printf("Test: Watch delivers changes to a prefix ...\n")
+
+	{
+		stream, stop := ck.Watch("cfg/", true, -1)
+		time.Sleep(100 * time.Millisecond)
+		ck.Put("cfg/a", "1")
+		ck.Put("other", "x")
+		ck.Append("cfg/a", "2")
+		ck.Delete("cfg/a")
+		ck.PutIfAbsent("cfg/b", "3")
+
+		e1 := next(stream)
+		expect(e1, PUT, "cfg/a", "1")
+		e2 := next(stream)
+		expect(e2, APPEND, "cfg/a", "12")
+		expect(next(stream), DELETE, "cfg/a", "")
+		expect(next(stream), PUTIFABSENT, "cfg/b", "3")
+		if e2.Revision != e1.Revision+2 {
+			t.Fatalf("revisions %v then %v", e1.Revision, e2.Revision)
+		}
+		stop()
+		for range stream {
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Watch resumes on the new primary ...\n")
+
+	{
+		_, v := ck.GetVersion("warmup")
+		stream, stop := ck.Watch("k", false, v)
+		ck.Put("k", "1")
+		expect(next(stream), PUT, "k", "1")
+		ck.Put("k", "2")
+		ck.Put("k", "3")
+
+		c.killPrimary(t)
+		ck.Put("k", "4")
+
+		expect(next(stream), PUT, "k", "2")
+		expect(next(stream), PUT, "k", "3")
+		expect(next(stream), PUT, "k", "4")
+		stop()
+
+		// everything since warmup, from the new primary alone.
+		stream, stop = ck.Watch("k", false, v)
+		for _, value := range []string{"1", "2", "3", "4"} {
+			expect(next(stream), PUT, "k", value)
+		}
+		stop()
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Watch falls behind after too many changes ...\n")
+
+	{
+		var el eventLog
+		for i := 1; i <= maxEvents+10; i++ {
+			el.add(Event{Revision: int64(i), Key: "k"})
+		}
+		rev := int64(maxEvents + 10)
+		if _, ok := el.since(WatchArgs{Key: "k", AfterRevision: 5}, rev); ok {
+			t.Fatalf("events after a discarded revision were reported")
+		}
+		found, ok := el.since(WatchArgs{Key: "k", AfterRevision: 20}, rev)
+		if !ok || len(found) != maxEvents-10 || found[0].Revision != 21 {
+			t.Fatalf("since(20) -> %v events, %v", len(found), ok)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Watch from now on misses nothing across a failover ...\n")
+
+	{
+		for i := range c.sa {
+			if c.sa[i].isdead() {
+				c.restart(t, i, "watch", Config{})
+			}
+		}
+		time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+		// the watching Clerk's first try goes nowhere.
+		ckw := MakeClerk(c.vshost, "")
+		ckw.primary = port("watch", 99)
+		stream, stop := ckw.Watch("n", false, -1)
+		ck.Put("n", "1")
+		c.killPrimary(t)
+		expect(next(stream), PUT, "n", "1")
+		stop()
+	}
+	fmt.Printf("  ... Passed\n")
+
+	c.kill()
+}
+
+func TestIncrement(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	c := startCluster(t, "incr", 2)
+	ck := MakeClerk(c.vshost, "")
+
+	fmt.Printf("Test: Increment ...\n")
+
+	{
+		if n, err := ck.Increment("n", 5); err != OK || n != 5 {
+			t.Fatalf("Increment of a missing key -> %v, %v", n, err)
+		}
+		if n, err := ck.Increment("n", -7); err != OK || n != -2 {
+			t.Fatalf("Increment by -7 -> %v, %v", n, err)
+		}
+		check(t, ck, "n", "-2")
+
+		ck.Put("s", "abc")
+		if _, err := ck.Increment("s", 1); err != ErrNotNumeric {
+			t.Fatalf("Increment of a string -> %v", err)
+		}
+		check(t, ck, "s", "abc")
+
+		ck.Put("big", "9223372036854775807")
+		if _, err := ck.Increment("big", 1); err != ErrOverflow {
+			t.Fatalf("Increment past MaxInt64 -> %v", err)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: A retried Increment is applied once ...\n")
+
+	{
+		args := OpArgs{Op: INCREMENT, Key: "n", Delta: 10,
+			Client: "incr-client", SeqNo: 1, Source: "incr-client"}
+		for i := 0; i < 3; i++ {
+			var reply OpReply
+			if !call(c.vck.Primary(), "PBServer.Operation", args, &reply) {
+				t.Fatalf("Operation RPC failed")
+			}
+			if reply.Err != OK || reply.Value != "8" {
+				t.Fatalf("attempt %v -> %v", i, reply)
+			}
+		}
+		check(t, ck, "n", "8")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Concurrent increments over an unreliable network ...\n")
+
+	{
+		const nclients = 3
+		const nincrs = 20
+		for _, pb := range c.sa {
+			pb.setunreliable(true)
+		}
+		var done sync.WaitGroup
+		for i := 0; i < nclients; i++ {
+			done.Add(1)
+			go func() {
+				defer done.Done()
+				ck := MakeClerk(c.vshost, "")
+				for j := 0; j < nincrs; j++ {
+					ck.Increment("counter", 1)
+				}
+			}()
+		}
+		done.Wait()
+		for _, pb := range c.sa {
+			pb.setunreliable(false)
+		}
+		check(t, ck, "counter", strconv.Itoa(nclients*nincrs))
+
+		c.killPrimary(t)
+		check(t, ck, "counter", strconv.Itoa(nclients*nincrs))
+		check(t, ck, "n", "8")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	c.kill()
+}
+
+func TestPersistence(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	cfgs := []Config{
+		{DataDir: t.TempDir(), SnapshotEvery: 7},
+		{DataDir: t.TempDir(), SnapshotEvery: 7},
+	}
+
+	// a fresh viewserver, with both servers on their old data.
+	boot := func(round int) *cluster {
+		return startClusterWithConfig(t, "persist"+strconv.Itoa(round), cfgs)
+	}
+
+	fmt.Printf("Test: State survives a whole-cluster restart ...\n")
+
+	incr := OpArgs{Op: INCREMENT, Key: "n", Delta: 1,
+		Client: "persist-client", SeqNo: 1, Source: "persist-client"}
+	{
+		c := boot(1)
+		ck := MakeClerk(c.vshost, "")
+		for i := 0; i < 20; i++ {
+			ck.Put("k"+strconv.Itoa(i), "v"+strconv.Itoa(i))
+		}
+		ck.Append("k3", "x")
+		ck.Delete("k4")
+		ck.PutTTL("brief", "gone", 100*time.Millisecond)
+		var reply OpReply
+		if !call(c.vck.Primary(), "PBServer.Operation", incr, &reply) || reply.Value != "1" {
+			t.Fatalf("Increment -> %v", reply)
+		}
+		c.kill()
+
+		c = boot(2)
+		ck = MakeClerk(c.vshost, "")
+		for i := 0; i < 20; i++ {
+			switch i {
+			case 3:
+				check(t, ck, "k3", "v3x")
+			case 4:
+				check(t, ck, "k4", "")
+			default:
+				check(t, ck, "k"+strconv.Itoa(i), "v"+strconv.Itoa(i))
+			}
+		}
+		check(t, ck, "brief", "")
+
+		// the retry is recognised, and not applied again.
+		reply = OpReply{}
+		if !call(c.vck.Primary(), "PBServer.Operation", incr, &reply) || reply.Value != "1" {
+			t.Fatalf("retried Increment -> %v", reply)
+		}
+		check(t, ck, "n", "1")
+
+		// and the recovered backup can take over.
+		ck.Put("after", "restart")
+		c.killPrimary(t)
+		check(t, ck, "after", "restart")
+		check(t, ck, "k3", "v3x")
+		c.kill()
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Replicas agree after everything restarts in place ...\n")
+
+	{
+		cfgs := []Config{{DataDir: t.TempDir()}, {DataDir: t.TempDir()}}
+		vscfg := viewservice.Config{LogFile: t.TempDir() + "/views"}
+		c := startClusterWithVS(t, "persist3", vscfg, cfgs)
+		ck := MakeClerk(c.vshost, "")
+		ck.Put("a", "1")
+
+		// the primary forwards x, and crashes before applying
+		// it itself; then everything goes down.
+		view, _ := c.vck.Get()
+		fargs := ForwardArgs{Ops: []OpArgs{{Op: PUT, Key: "x", Value: "1",
+			Client: "persist3-client", SeqNo: 1, Source: view.Primary}}}
+		var freply ForwardReply
+		if !call(view.Backup, "PBServer.Forward", fargs, &freply) || freply.Err != OK {
+			t.Fatalf("Forward -> %v", freply.Err)
+		}
+		c.vs.Kill(c.vsterm)
+		for i := range c.sa {
+			c.sa[i].kill(c.st[i])
+		}
+		time.Sleep(time.Second)
+
+		// the same servers, on the same addresses and data, and
+		// a viewserver that remembers the old view, all at once:
+		// the old primary's first ping makes the old backup the
+		// primary, with the old primary as its backup.
+		c.vsterm = make(chan interface{})
+		c.vs = viewservice.StartServerWithConfig(c.vshost, vscfg, c.vsterm)
+		order := []int{0, 1}
+		if view.Primary == c.sa[1].me {
+			order = []int{1, 0}
+		}
+		for _, i := range order {
+			c.st[i] = make(chan interface{})
+			c.sa[i] = StartServerWithConfig(c.vshost, port("persist3", i+1), cfgs[i], c.st[i])
+			time.Sleep(2 * viewservice.PingInterval)
+		}
+		for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+			if v, _ := c.vck.Get(); v.Primary != "" && v.Backup != "" {
+				break
+			}
+			time.Sleep(viewservice.PingInterval)
+		}
+		time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+		view, _ = c.vck.Get()
+		if view.Primary == "" || view.Backup == "" {
+			t.Fatalf("no primary/backup after the restart: %v", view)
+		}
+		var pd, bd DigestReply
+		if !call(view.Primary, "PBServer.Digest", DigestArgs{}, &pd) ||
+			!call(view.Backup, "PBServer.Digest", DigestArgs{}, &bd) {
+			t.Fatalf("Digest RPC failed")
+		}
+		if keys, clients := (digest{pd.Keys, pd.Clients}).diff(digest{bd.Keys, bd.Clients}); len(keys)+len(clients) != 0 {
+			t.Fatalf("primary and backup differ in %v key and %v client buckets", len(keys), len(clients))
+		}
+		ck = MakeClerk(c.vshost, "")
+		x := ck.Get("x")
+		c.killPrimary(t)
+		check(t, ck, "x", x)
+		check(t, ck, "a", "1")
+		c.kill()
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: A torn log record is ignored ...\n")
+
+	{
+		dir := t.TempDir()
+		l, _, _, err := openWAL(dir)
+		if err != nil {
+			t.Fatalf("openWAL: %v", err)
+		}
+		l.append(OpArgs{Op: PUT, Key: "a", Value: "1"})
+		l.append(OpArgs{Op: PUT, Key: "b", Value: "2"})
+		l.snapshot(PushArgs{KVStore: map[string]string{"a": "1", "b": "2"}})
+		l.append(OpArgs{Op: PUT, Key: "c", Value: "3"})
+		l.f.WriteString(`{"Index":4,"Args":{"Op":"Pu`)
+		l.close()
+
+		l, snap, records, err := openWAL(dir)
+		if err != nil {
+			t.Fatalf("openWAL: %v", err)
+		}
+		if len(snap.State.KVStore) != 2 || snap.Index != 2 {
+			t.Fatalf("snapshot %v", snap)
+		}
+		if len(records) != 1 || records[0].Args.Key != "c" || records[0].Index != 3 {
+			t.Fatalf("records %v", records)
+		}
+		l.append(OpArgs{Op: PUT, Key: "d", Value: "4"})
+		l.close()
+
+		_, _, records, _ = openWAL(dir)
+		if len(records) != 2 || records[1].Args.Key != "d" || records[1].Index != 4 {
+			t.Fatalf("records after a torn write %v", records)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestIncrementalPush(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: A digest differs only in the changed buckets ...\n")
+
+	{
+		database := map[string]string{}
+		versions := map[string]int64{}
+		for i := 0; i < 500; i++ {
+			key := "k" + strconv.Itoa(i)
+			database[key] = "v"
+			versions[key] = int64(i + 1)
+		}
+		var before, after digest
+		before.rebuild(database, versions, nil, nil)
+		database["k17"] = "changed"
+		versions["k17"] = 501
+		after.rebuild(database, versions, nil, nil)
+		keys, clients := after.diff(before)
+		if len(keys) != 1 || keys[0] != bucketOf("k17") || len(clients) != 0 {
+			t.Fatalf("diff -> %v %v", keys, clients)
+		}
+		if keys, _ := after.diff(digest{}); len(keys) != digestBuckets {
+			t.Fatalf("diff against nothing -> %v buckets", len(keys))
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: A restarted backup catches up on what it missed ...\n")
+
+	{
+		tag := "incpush"
+		cfgs := []Config{{DataDir: t.TempDir()}, {DataDir: t.TempDir()}}
+		c := startClusterWithConfig(t, tag, cfgs)
+		ck := MakeClerk(c.vshost, "")
+		for i := 0; i < 200; i++ {
+			ck.Put("k"+strconv.Itoa(i), "v"+strconv.Itoa(i))
+		}
+
+		b := c.killBackup(t)
+		ck.Put("k1", "new")
+		ck.Delete("k2")
+		ck.Put("fresh", "x")
+		ck.Increment("n", 3)
+
+		c.restart(t, b, tag, cfgs[b])
+		time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+
+		var pd, bd DigestReply
+		if !call(c.vck.Primary(), "PBServer.Digest", DigestArgs{}, &pd) ||
+			!call(c.sa[b].me, "PBServer.Digest", DigestArgs{}, &bd) {
+			t.Fatalf("Digest RPC failed")
+		}
+		if keys, clients := (digest{pd.Keys, pd.Clients}).diff(digest{bd.Keys, bd.Clients}); len(keys) != 0 || len(clients) != 0 {
+			t.Fatalf("backup still differs in %v key and %v client buckets", len(keys), len(clients))
+		}
+
+		c.killPrimary(t)
+		check(t, ck, "k1", "new")
+		check(t, ck, "k2", "")
+		check(t, ck, "k3", "v3")
+		check(t, ck, "fresh", "x")
+		check(t, ck, "n", "3")
+		c.kill()
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestChunkedPush(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Chunks put a push back together ...\n")
+
+	{
+		pargs := PushArgs{KVStore: map[string]string{}, Versions: map[string]int64{},
+			Expires: map[string]int64{"k5": 99}, OpCache: map[string]Result{"c": {Acked: 3}},
+			Revision: 100, Sessions: sessionTable{"s": 7}}
+		var keys []string
+		for i := 0; i < 100; i++ {
+			key := "k" + strconv.Itoa(i)
+			pargs.KVStore[key] = strings.Repeat("x", 50)
+			pargs.Versions[key] = int64(i + 1)
+			keys = append(keys, key)
+		}
+		for i := 0; i < 50; i++ {
+			pargs.Events = append(pargs.Events,
+				Event{Revision: int64(i + 51), Op: PUT, Key: "k1", Value: strings.Repeat("y", 50)})
+		}
+		sort.Strings(keys)
+		src := newPushSource(pargs, keys, 500)
+		var chunks []PushArgs
+		for n := 0; ; n++ {
+			chunk := src.chunk(n)
+			chunks = append(chunks, chunk)
+			if chunk.Last {
+				break
+			}
+		}
+		// events count too, so they can't all ride in the last chunk.
+		if len(chunks) < 15 || len(chunks[len(chunks)-1].Events) > 10 {
+			t.Fatalf("%v chunks", len(chunks))
+		}
+		// a resumed push asks for a chunk again.
+		if again := src.chunk(3); !reflect.DeepEqual(again, chunks[3]) {
+			t.Fatalf("chunk 3 differs when read again")
+		}
+		var staged PushArgs
+		for i, chunk := range chunks {
+			if len(chunk.KVStore)+len(chunk.Events) > 10 || chunk.Last != (i == len(chunks)-1) {
+				t.Fatalf("chunk %v has %v keys, Last %v", i, len(chunk.KVStore), chunk.Last)
+			}
+			staged.merge(chunk)
+		}
+		if len(staged.KVStore) != 100 || staged.Versions["k42"] != 43 ||
+			staged.Expires["k5"] != 99 || staged.OpCache["c"].Acked != 3 ||
+			staged.Revision != 100 || len(staged.Events) != 50 ||
+			staged.Events[49].Revision != 100 || staged.Sessions["s"] != 7 {
+			t.Fatalf("reassembled push differs")
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: A chunked push survives an unreliable backup ...\n")
+
+	{
+		tag := "chunks"
+		cfgs := []Config{{PushChunkBytes: 1024}, {PushChunkBytes: 1024}}
+		c := startClusterWithConfig(t, tag, cfgs)
+		ck := MakeClerk(c.vshost, "")
+		for i := 0; i < 300; i++ {
+			ck.Put("k"+strconv.Itoa(i), strings.Repeat(strconv.Itoa(i%10), 100))
+		}
+
+		b := c.killBackup(t)
+		c.restart(t, b, tag, cfgs[b])
+		c.sa[b].setunreliable(true)
+		// wait for the new backup to have been pushed to.
+		for iters := 0; iters < 50; iters++ {
+			var pd, bd DigestReply
+			if call(c.sa[1-b].me, "PBServer.Digest", DigestArgs{}, &pd) &&
+				call(c.sa[b].me, "PBServer.Digest", DigestArgs{}, &bd) {
+				if keys, _ := (digest{pd.Keys, pd.Clients}).diff(digest{bd.Keys, bd.Clients}); len(keys) == 0 {
+					break
+				}
+			}
+			time.Sleep(viewservice.PingInterval)
+		}
+		c.sa[b].setunreliable(false)
+
+		c.killPrimary(t)
+		for i := 0; i < 300; i++ {
+			check(t, ck, "k"+strconv.Itoa(i), strings.Repeat(strconv.Itoa(i%10), 100))
+		}
+		c.kill()
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestSessions(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	// long enough for a session to outlast a failover.
+	timeout := 1500 * time.Millisecond
+	cfgs := []Config{{SessionTimeout: timeout}, {SessionTimeout: timeout}}
+	c := startClusterWithConfig(t, "session", cfgs)
+
+	// send ck's last op again, as a late retry would.
+	retry := func(ck *Clerk, key string, value string) OpReply {
+		args := OpArgs{Op: PUT, Key: key, Value: value, Client: ck.me,
+			SeqNo: ck.seqno, Source: ck.me, Session: true}
+		for iters := 0; iters < 50; iters++ {
+			var reply OpReply
+			if !call(c.vck.Primary(), "PBServer.Operation", args, &reply) {
+				t.Fatalf("Operation RPC failed")
+			}
+			if reply.Err != ErrWrongServer {
+				return reply
+			}
+			time.Sleep(viewservice.PingInterval)
+		}
+		t.Fatalf("no primary took the retry")
+		return OpReply{}
+	}
+
+	fmt.Printf("Test: An idle session times out ...\n")
+
+	ck1 := MakeClerk(c.vshost, "")
+	{
+		ck1.Put("a", "1")
+		// stop the keepalives, as a partition would.
+		close(ck1.stop)
+		ck1.stop = nil
+		time.Sleep(2 * timeout)
+
+		if reply := retry(ck1, "a", "1"); reply.Err != ErrSessionExpired {
+			t.Fatalf("late retry -> %v", reply.Err)
+		}
+		check(t, ck1, "a", "1")
+		ck1.Put("b", "x")
+		check(t, ck1, "b", "x")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: A Clerk reports a write lost with its session ...\n")
+
+	{
+		ck := MakeClerk(c.vshost, "")
+		ck.Put("e", "1")
+		close(ck.stop)
+		ck.stop = nil
+		time.Sleep(2 * timeout)
+
+		// an unanswered first try means the write may have run
+		// before the session ended.
+		ck.primary = port("session", 99)
+		if err := ck.Put("e", "2"); err != ErrSessionExpired {
+			t.Fatalf("Put after the session ended -> %v", err)
+		}
+		check(t, ck, "e", "1")
+
+		// a read is just tried again in a new session.
+		close(ck.stop)
+		ck.stop = nil
+		time.Sleep(2 * timeout)
+		ck.primary = port("session", 99)
+		check(t, ck, "e", "1")
+		if err := ck.Put("e", "3"); err != OK {
+			t.Fatalf("Put in a new session -> %v", err)
+		}
+		ck.Close()
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: KeepAlives keep a session open until Close ...\n")
+
+	ck2 := MakeClerk(c.vshost, "")
+	ck3 := MakeClerk(c.vshost, "")
+	{
+		ck2.Put("c", "1")
+		ck3.Put("d", "1")
+		time.Sleep(2 * timeout)
+		if reply := retry(ck2, "c", "1"); reply.Err != OK {
+			t.Fatalf("retry in a live session -> %v", reply.Err)
+		}
+
+		ck2.Close()
+		if reply := retry(ck2, "c", "2"); reply.Err != ErrSessionExpired {
+			t.Fatalf("retry after Close -> %v", reply.Err)
+		}
+		check(t, ck3, "c", "1")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Sessions end on the backup too ...\n")
+
+	{
+		c.killPrimary(t)
+		if reply := retry(ck2, "c", "2"); reply.Err != ErrSessionExpired {
+			t.Fatalf("retry of a closed session after failover -> %v", reply.Err)
+		}
+		if reply := retry(ck3, "d", "1"); reply.Err != OK {
+			t.Fatalf("retry of a live session after failover -> %v", reply.Err)
+		}
+		check(t, ck3, "c", "1")
+		check(t, ck3, "d", "1")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	ck1.Close()
+	ck3.Close()
+	c.kill()
+}
+
+func TestPipeline(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	c := startCluster(t, "pipe", 2)
+	ck := MakeClerk(c.vshost, "")
+	ck.SetWindow(16)
+
+	fmt.Printf("Test: Pipelined ops all complete ...\n")
+
+	{
+		calls := []*Call{}
+		for i := 0; i < 200; i++ {
+			calls = append(calls, ck.Go(OpArgs{Op: PUT, Key: "k" + strconv.Itoa(i), Value: strconv.Itoa(i)}))
+		}
+		for _, call := range calls {
+			if r := <-call.Done; r.Reply.Err != OK {
+				t.Fatalf("%v -> %v", r.Args, r.Reply.Err)
+			}
+		}
+		for i := 0; i < 200; i++ {
+			check(t, ck, "k"+strconv.Itoa(i), strconv.Itoa(i))
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Out-of-order retries are each applied once ...\n")
+
+	{
+		incr := func(seqno int, acked int) OpReply {
+			args := OpArgs{Op: INCREMENT, Key: "r", Delta: 1, Client: "pipe-client",
+				SeqNo: seqno, Acked: acked, Source: "pipe-client"}
+			var reply OpReply
+			if !call(c.vck.Primary(), "PBServer.Operation", args, &reply) {
+				t.Fatalf("Operation RPC failed")
+			}
+			return reply
+		}
+		incr(3, 0)
+		incr(5, 0)
+		if reply := incr(3, 0); reply.Value != "1" {
+			t.Fatalf("retry of 3 -> %v", reply)
+		}
+		if reply := incr(5, 0); reply.Value != "2" {
+			t.Fatalf("retry of 5 -> %v", reply)
+		}
+		incr(4, 0)
+		incr(6, 5)
+		incr(3, 0)
+		check(t, ck, "r", "4")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Pipelined ops over an unreliable network ...\n")
+
+	{
+		for _, pb := range c.sa {
+			pb.setunreliable(true)
+		}
+		calls := []*Call{}
+		for i := 0; i < 100; i++ {
+			calls = append(calls, ck.Go(OpArgs{Op: INCREMENT, Key: "n", Delta: 1}))
+			calls = append(calls, ck.Go(OpArgs{Op: APPEND, Key: "log", Value: "x" + strconv.Itoa(i) + "."}))
+		}
+		for _, call := range calls {
+			<-call.Done
+		}
+		for _, pb := range c.sa {
+			pb.setunreliable(false)
+		}
+		check(t, ck, "n", "100")
+		c.killPrimary(t)
+		check(t, ck, "n", "100")
+		log := ck.Get("log")
+		for i := 0; i < 100; i++ {
+			if n := strings.Count(log, "x"+strconv.Itoa(i)+"."); n != 1 {
+				t.Fatalf("append %v applied %v times", i, n)
+			}
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	ck.Close()
+	c.kill()
+}
+
+func TestBatchedForward(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	c := startCluster(t, "fwdbatch", 2)
+
+	fmt.Printf("Test: A retry in the same batch as its first try ...\n")
+
+	{
+		args := OpArgs{Op: INCREMENT, Key: "n", Delta: 1,
+			Client: "fwdbatch-client", SeqNo: 1, Source: "fwdbatch-client"}
+		var done sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			done.Add(1)
+			go func() {
+				defer done.Done()
+				var reply OpReply
+				call(c.vck.Primary(), "PBServer.Operation", args, &reply)
+			}()
+		}
+		done.Wait()
+		ck := MakeClerk(c.vshost, "")
+		check(t, ck, "n", "1")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Concurrent ops share forwards ...\n")
+
+	{
+		const nclients = 10
+		const nappends = 50
+		view, _ := c.vck.Get()
+		var backup *PBServer
+		for _, pb := range c.sa {
+			if pb.me == view.Backup {
+				backup = pb
+			}
+		}
+		before := atomic.LoadInt32(&backup.forwards)
+
+		var done sync.WaitGroup
+		for i := 0; i < nclients; i++ {
+			done.Add(1)
+			go func(i int) {
+				defer done.Done()
+				ck := MakeClerk(c.vshost, "")
+				for j := 0; j < nappends; j++ {
+					ck.Append("k"+strconv.Itoa(i), "x")
+				}
+				ck.Close()
+			}(i)
+		}
+		done.Wait()
+
+		// each client's session takes a Register and a Close too.
+		ops := nclients * (nappends + 2)
+		if n := int(atomic.LoadInt32(&backup.forwards) - before); n >= ops {
+			t.Fatalf("%v forwards for %v ops", n, ops)
+		}
+		c.killPrimary(t)
+		ck := MakeClerk(c.vshost, "")
+		for i := 0; i < nclients; i++ {
+			check(t, ck, "k"+strconv.Itoa(i), strings.Repeat("x", nappends))
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	c.kill()
+}
+
+// stand in for the server at port, asking decide whether to pass
+// each connection through to it or to drop it.
+func gate(t *testing.T, port string, decide func() bool) {
+	portx := port + "x"
+	os.Remove(portx)
+	if os.Rename(port, portx) != nil {
+		t.Fatalf("gate rename failed")
+	}
+	l, err := net.Listen("unix", port)
+	if err != nil {
+		t.Fatalf("gate listen failed: %v", err)
+	}
+	go func() {
+		defer l.Close()
+		defer os.Remove(portx)
+		for {
+			c1, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c1.Close()
+				if !decide() {
+					return
+				}
+				c2, err := net.Dial("unix", portx)
+				if err != nil {
+					return
+				}
+				defer c2.Close()
+				go io.Copy(c1, c2)
+				io.Copy(c2, c1)
+			}()
+		}
+	}()
+}
+
+func TestBatchedForwardFailover(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "fwdfail"
+	vshost := port(tag+"v", 1)
+	vsterm := make(chan interface{})
+	// slow pings, so that the primary doesn't learn of the new
+	// view on a tick; no leases, so that it is made right away.
+	vs := viewservice.StartServerWithConfig(vshost,
+		viewservice.Config{PingInterval: time.Second, Lease: -1}, vsterm)
+	vck := viewservice.MakeClerk("", vshost)
+
+	st := []chan interface{}{make(chan interface{}), make(chan interface{})}
+	s1 := StartServer(vshost, port(tag, 1), st[0])
+	time.Sleep(2 * time.Second)
+	s2 := StartServer(vshost, port(tag, 2), st[1])
+	for iters := 0; iters < 10; iters++ {
+		if v, _ := vck.Get(); v.Backup == s2.me {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	// let s1 ack the view.
+	time.Sleep(2 * time.Second)
+	if v, _ := vck.Get(); v.Primary != s1.me || v.Backup != s2.me {
+		t.Fatalf("wanted view (%v,%v), got %v", s1.me, s2.me, v)
+	}
+
+	fmt.Printf("Test: Batched ops fail if the primary is replaced while admitting them ...\n")
+
+	{
+		// 0: pass connections to s2; 1: wait for a decision;
+		// 2: drop them.
+		mode := int32(0)
+		decisions := make(chan bool)
+		gate(t, port(tag, 2), func() bool {
+			switch atomic.LoadInt32(&mode) {
+			case 1:
+				return <-decisions
+			case 2:
+				return false
+			}
+			return true
+		})
+
+		ck := MakeClerk(vshost, "")
+		ck.PutTTL("t", "x", 100*time.Millisecond)
+
+		// hold s1 up forwarding z, while a and then a Get of
+		// t, now due to expire, wait behind it.
+		atomic.StoreInt32(&mode, 1)
+		op := func(args OpArgs) chan OpReply {
+			replyCh := make(chan OpReply, 1)
+			go func() {
+				var reply OpReply
+				call(s1.me, "PBServer.Operation", args, &reply)
+				replyCh <- reply
+			}()
+			time.Sleep(50 * time.Millisecond)
+			return replyCh
+		}
+		op(OpArgs{Op: PUT, Key: "z", Value: "1", Client: "fwdfail-z", SeqNo: 1, Source: "fwdfail-z"})
+		a := op(OpArgs{Op: PUT, Key: "a", Value: "1", Client: "fwdfail-a", SeqNo: 1, Source: "fwdfail-a"})
+		op(OpArgs{Op: GET, Key: "t", Client: "fwdfail-g", SeqNo: 1, Source: "fwdfail-g"})
+
+		// s2 takes over. it gets z, but expiring t fails to
+		// reach it, and s1 finds out about the new view.
+		if _, err := vck.PromoteBackup(); err != viewservice.OK {
+			t.Fatalf("PromoteBackup: %v", err)
+		}
+		decisions <- true
+		atomic.StoreInt32(&mode, 2)
+
+		// a was admitted by a primary that had been replaced,
+		// so it must fail, and s2 must not have it.
+		reply := <-a
+		atomic.StoreInt32(&mode, 0)
+		if reply.Err != ErrWrongServer {
+			t.Fatalf("Put of a on the old primary -> %v", reply.Err)
+		}
+		ck2 := MakeClerk(vshost, "")
+		check(t, ck2, "a", "")
+		if v, _ := vck.Get(); v.Primary != s2.me {
+			t.Fatalf("wanted %v as primary, got %v", s2.me, v)
+		}
+		ck2.Close()
+		ck.Close()
+	}
+	fmt.Printf("  ... Passed\n")
+
+	s1.kill(st[0])
+	s2.kill(st[1])
+	time.Sleep(time.Second)
+	vs.Kill(vsterm)
+}
+
+func TestLeaseReads(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	c := startCluster(t, "lease", 2)
+	ck := MakeClerk(c.vshost, "")
+	view, _ := c.vck.Get()
+	var backup *PBServer
+	for _, pb := range c.sa {
+		if pb.me == view.Backup {
+			backup = pb
+		}
+	}
+
+	fmt.Printf("Test: Gets under a lease aren't forwarded ...\n")
+
+	{
+		ck.Put("a", "1")
+		// let the primary renew its lease on a tick.
+		time.Sleep(2 * viewservice.PingInterval)
+
+		before := atomic.LoadInt32(&backup.forwards)
+		for i := 0; i < 50; i++ {
+			check(t, ck, "a", "1")
+		}
+		if n := atomic.LoadInt32(&backup.forwards) - before; n != 0 {
+			t.Fatalf("%v forwards for Gets under a lease", n)
+		}
+
+		ck.Put("a", "2")
+		if atomic.LoadInt32(&backup.forwards) == before {
+			t.Fatalf("Put wasn't forwarded")
+		}
+		check(t, ck, "a", "2")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Scans under a lease aren't forwarded ...\n")
+
+	{
+		time.Sleep(2 * viewservice.PingInterval)
+		before := atomic.LoadInt32(&backup.forwards)
+		for i := 0; i < 20; i++ {
+			if entries, _ := ck.Scan("", "", 10); len(entries) != 1 || entries[0].Value != "2" {
+				t.Fatalf("Scan -> %v", entries)
+			}
+		}
+		if n := atomic.LoadInt32(&backup.forwards) - before; n != 0 {
+			t.Fatalf("%v forwards for Scans under a lease", n)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Backup takes over with the same state ...\n")
+
+	{
+		c.killPrimary(t)
+		check(t, ck, "a", "2")
+		ck.Put("b", "3")
+		check(t, ck, "b", "3")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	ck.Close()
+	c.kill()
+}
+
+func TestLongLease(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	lease := 3 * viewservice.DeadPings * viewservice.PingInterval
+	c := startClusterWithVS(t, "longlease", viewservice.Config{Lease: lease}, make([]Config, 2))
+	ck := MakeClerk(c.vshost, "")
+
+	fmt.Printf("Test: No new primary until the old one's lease runs out ...\n")
+
+	{
+		ck.Put("a", "1")
+		view, _ := c.vck.Get()
+		for i := range c.sa {
+			if c.sa[i].me == view.Primary {
+				c.sa[i].kill(c.st[i])
+			}
+		}
+		// the last lease was granted at most a ping ago.
+		killed := time.Now()
+		for time.Since(killed) < lease-2*viewservice.PingInterval {
+			if v, _ := c.vck.Get(); v.Viewnum != view.Viewnum {
+				t.Fatalf("view %v %v after the primary died, within its lease",
+					v, time.Since(killed))
+			}
+			time.Sleep(viewservice.PingInterval / 2)
+		}
+
+		for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+			if v, _ := c.vck.Get(); v.Primary == view.Backup {
+				break
+			}
+			time.Sleep(viewservice.PingInterval)
+		}
+		if v, _ := c.vck.Get(); v.Primary != view.Backup {
+			t.Fatalf("backup never took over after the lease; view %v", v)
+		}
+		check(t, ck, "a", "1")
+	}
+	fmt.Printf("  ... Passed\n")
+
+	ck.Close()
+	c.kill()
+}
+
+func TestReplicatedClerk(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	c := startCluster(t, "repl", 2)
+
+	fmt.Printf("Test: A Clerk gets past a dead viewservice peer ...\n")
+
+	{
+		ck := MakeReplicatedClerk([]string{port("replv", 9), c.vshost}, "")
+		ck.Put("a", "1")
+		check(t, ck, "a", "1")
+		c.killPrimary(t)
+		ck.Append("a", "2")
+		check(t, ck, "a", "12")
+		ck.Close()
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: A server gets past a dead viewservice peer ...\n")
+
+	{
+		ck := MakeClerk(c.vshost, "")
+		for i := range c.sa {
+			if c.sa[i].isdead() {
+				c.st[i] = make(chan interface{})
+				c.sa[i] = StartReplicatedServer([]string{port("replv", 9), c.vshost},
+					port("repl", i+1), Config{}, c.st[i])
+			}
+		}
+		for iters := 0; iters < viewservice.DeadPings*3; iters++ {
+			if v, _ := c.vck.Get(); v.Backup != "" {
+				break
+			}
+			time.Sleep(viewservice.PingInterval)
+		}
+		if v, _ := c.vck.Get(); v.Backup == "" {
+			t.Fatalf("restarted server never became the backup; view %v", v)
+		}
+		time.Sleep(viewservice.PingInterval * viewservice.DeadPings)
+		c.killPrimary(t)
+		check(t, ck, "a", "12")
+		ck.Close()
+	}
+	fmt.Printf("  ... Passed\n")
+
+	c.kill()
+}
@@ -1,56 +1,129 @@
 package pbservice
 
-import "umich.edu/eecs491/proj2/viewservice"
+import (
+	"time"
+
+	"umich.edu/eecs491/proj2/viewservice"
+)
 
 // Error values
 type Err string
 
 const (
-	OK             = "OK"             // Success
-	ErrNoKey       = "ErrNoKey"       // No key (Get only)
-	ErrWrongServer = "ErrWrongServer" // Wrong primary
+	OK                = "OK"                // Success
+	ErrNoKey          = "ErrNoKey"          // No key (Get only)
+	ErrWrongServer    = "ErrWrongServer"    // Wrong primary
+	ErrCompacted      = "ErrCompacted"      // Events asked for are no longer kept (Watch only)
+	ErrNotNumeric     = "ErrNotNumeric"     // Value is not an integer (Increment only)
+	ErrOverflow       = "ErrOverflow"       // Result does not fit in an int64 (Increment only)
+	ErrSessionExpired = "ErrSessionExpired" // The client's session was closed or timed out
 )
 
 // Operations
 type Op  string
 
 const (
-	GET        = "Get"
-	PUT        = "Put"
-	APPEND     = "Append"
+	GET          = "Get"
+	PUT          = "Put"
+	APPEND       = "Append"
+	DELETE       = "Delete"
+	CAS          = "CompareAndSwap" // Put if the value is Expected
+	PUTIFABSENT  = "PutIfAbsent"    // Put if the key does not exist
+	PUTIFVERSION = "PutIfVersion"   // Put if the key is at Version
+	EXPIRE       = "Expire"         // Primary to Backup only: a TTL ran out
+	BATCH        = "Batch"          // Ops, atomically, if all Guards hold
+	SCAN         = "Scan"           // keys from Key up to End, in order
+	INCREMENT    = "Increment"      // add Delta to an integer value
+	REGISTER     = "Register"       // start a session for Client
+	KEEPALIVE    = "KeepAlive"      // keep Client's session from timing out
+	CLOSE        = "Close"          // end Client's session
+	ENDSESSION   = "EndSession"     // Primary to Backup only: session Key timed out
 )
 
-// An Operation: Get, Put, or Append
+// An Operation: Get, Put, Append, Delete, or one of the
+// conditional writes CompareAndSwap, PutIfAbsent and PutIfVersion
 //
 // This can be sent from Client to Primary, or
 // from Primary to Backup
+//
+// Any write may carry a TTL, after which the key reads as
+// missing. An Append or Increment without a TTL keeps the
+// key's old one; other writes without one clear it.
 
 // Operation Arguments
 type OpArgs struct {
-	Op      Op       // Operation being performed
-	Key     string   // Key being fetched/modified
-	Value   string   // Value to Put/Append (if modification)
-	Client  string   // Identifier for client requesting this operation
-	SeqNo   int      // Sequence # of this operation on this client
-	Source  string   // Source of this call (Client ID or Primary ID)
+	Op             Op            // Operation being performed
+	Key            string        // Key being fetched/modified
+	Value          string        // Value to Put/Append (if modification)
+	Expected       string        // Value the key must have (CompareAndSwap only)
+	Version        int64         // Version the key must be at (PutIfVersion only)
+	TTL            time.Duration // If > 0, the written key expires after this long
+	Expires        int64         // When the key expires, in UnixNano; set by the Primary
+	Ops            []OpArgs      // Batch only: the ops, applied in order
+	Guards         []Guard       // Batch only: preconditions for the whole batch
+	End            string        // Scan only: first key past the range; "" for no end
+	Limit          int           // Scan only: most keys to return
+	Delta          int64         // Increment only: amount to add; may be negative
+	Client         string        // Identifier for client requesting this operation
+	SeqNo          int           // Sequence # of this operation on this client
+	Source         string        // Source of this call (Client ID or Primary ID)
+	Session        bool          // Client has Registered a session
+	SessionExpires int64         // When Client's session times out, in UnixNano; set by the Primary
+	Acked          int           // Client has the reply to every op up to this SeqNo
+}
+
+// A precondition for a Batch. With CheckVersion, the key must
+// be at Version (0 meaning it doesn't exist); otherwise it must
+// exist and have value Expected.
+type Guard struct {
+	Key          string
+	Expected     string
+	Version      int64
+	CheckVersion bool
 }
 
 // Operation Results
 type OpReply struct {
-	Err    Err       // One of the Err codes
-	Value  string    // value of key (Get only)
+	Err            Err           // One of the Err codes
+	Value          string        // value of key (Get only; conditional writes: before the op)
+	Applied        bool          // whether a conditional write took place
+	Version        int64         // key's version after the op; 0 if it doesn't exist
+	Results        []OpReply     // Batch only: one per op, if the batch was Applied
+	Entries        []KeyValue    // Scan only: the keys found, in order
+	Cursor         string        // Scan only: where the next page starts; "" if done
+	SessionTimeout time.Duration // Register only: how long an idle session lasts
+}
+
+type KeyValue struct {
+	Key     string
+	Value   string
+	Version int64
 }
 
 // Each active server must remember the last successful response for
 // at least some operations from each client. The response is tagged
 // with the sequence number the client used to make the request
 //
-// Note that you might not need to remember *all* (types of) past
-// results...
+// A client may have several ops in flight at once, so replies
+// are kept for every op it has not yet said it has the reply
+// to (see OpArgs.Acked), which may have completed out of order.
 
 type Result struct {
-	SeqNo int 
-	V     OpReply
+	Acked int             // the client has the replies to every op up to here
+	Done  map[int]OpReply // replies to ops after Acked, by SeqNo
+}
+
+// Forward
+//
+// Send ops from Primary to Backup, to be applied in the order
+// given. Each is handled as its own Operation would be.
+
+type ForwardArgs struct {
+	Ops []OpArgs
+}
+
+type ForwardReply struct {
+	Err Err
 }
 
 // Push
@@ -65,8 +138,66 @@ type PushArgs struct {
 	KVStore  map[string]string // The current DB at the caller
 	OpCache  map[string]Result // The current cache of past results
 	View     viewservice.View  // The current View at the caller
+	Versions map[string]int64  // Version of each key
+	Revision int64             // Version given to the last write
+	Expires  map[string]int64  // When each key with a TTL expires
+	Events   []Event           // Recent changes, for Watch
+	Sessions map[string]int64  // When each client's session times out
+
+	// If Partial, only the listed buckets of keys and of opcache
+	// clients are sent, and the rest of the backup's state is kept.
+	Partial       bool
+	KeyBuckets    []int
+	ClientBuckets []int
+
+	// Which chunk of which transfer this is; see transfer.go.
+	Transfer string
+	Chunk    int
+	Last     bool
 }
 
 type PushReply struct {
-	Err Err
+	Err  Err
+	Next int // the chunk the backup wants next
+}
+
+// Digest
+//
+// Ask a backup for a hash of each bucket of its state, so the
+// primary can Push only the buckets that differ.
+
+type DigestArgs struct {
+}
+
+type DigestReply struct {
+	Err     Err
+	Keys    []uint64 // one hash per bucket of keys
+	Clients []uint64 // one hash per bucket of opcache clients
+}
+
+// Watch
+//
+// Wait for changes to Key (or, with Prefix, to any key starting
+// with Key) made after revision AfterRevision, and return them.
+// AfterRevision < 0 means from now on. Only the primary answers.
+
+type WatchArgs struct {
+	Key           string
+	Prefix        bool
+	AfterRevision int64
+	Timeout       time.Duration // zero means the server's default; < 0, don't wait
+}
+
+type WatchReply struct {
+	Err      Err
+	Events   []Event // in revision order; empty if the wait timed out
+	Revision int64   // watch again after this revision
+}
+
+// One change to a key.
+type Event struct {
+	Revision int64 // the store's revision after the change
+	Op       Op    // the op that made it, e.g. Put, Delete or Expire
+	Key      string
+	Value    string // the new value; "" after a Delete or Expire
 }
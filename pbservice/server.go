@@ -6,11 +6,10 @@ import (
 	"math/rand"
 	"net"
 	"net/rpc"
-	"os"
 	"sync/atomic"
-	"syscall"
 	"time"
 
+	"umich.edu/eecs491/proj2/transport"
 	"umich.edu/eecs491/proj2/viewservice"
 )
 
@@ -19,12 +18,38 @@ type PBServer struct {
 	l          net.Listener
 	dead       <-chan interface{} // for testing
 	unreliable int32              // for testing
+	forwards   int32              // for testing: Forward RPCs taken
 	me         string
 	vs         *viewservice.Clerk
+	config     Config
 
 	impl PBServerImpl
 }
 
+// Optional PBServer settings; the zero value gives the defaults.
+type Config struct {
+	// How often to ping the viewservice until it has told us
+	// its own interval. Defaults to viewservice.PingInterval.
+	PingInterval time.Duration
+
+	// If set, the server's state is kept in this directory (one
+	// per server) and recovered from it when the server is
+	// started on it again.
+	DataDir string
+
+	// How many ops to log between snapshots of the state in
+	// DataDir. Defaults to DefaultSnapshotEvery.
+	SnapshotEvery int
+
+	// Roughly how many bytes of keys and values to send to a
+	// backup per Push RPC. Defaults to DefaultPushChunkBytes.
+	PushChunkBytes int
+
+	// How long a client session lasts without being used.
+	// Defaults to DefaultSessionTimeout.
+	SessionTimeout time.Duration
+}
+
 // tell the server to shut itself down.
 // term should be the same channel as pb.dead
 func (pb *PBServer) kill(term chan interface{}) {
@@ -33,6 +58,12 @@ func (pb *PBServer) kill(term chan interface{}) {
 	pb.l.Close()
 }
 
+// shut the server down for good, as kill does; for programs
+// that run a PBServer outside of the tests.
+func (pb *PBServer) Kill(term chan interface{}) {
+	pb.kill(term)
+}
+
 // call this to find out if the server is dead.
 func (pb *PBServer) isdead() bool {
 	select {
@@ -55,18 +86,49 @@ func (pb *PBServer) isunreliable() bool {
 	return atomic.LoadInt32(&pb.unreliable) != 0
 }
 
+// the ping interval the viewservice asked for, or our
+// configured one if we haven't heard from it yet.
+func (pb *PBServer) pingInterval() time.Duration {
+	if interval, _, ok := pb.vs.Timing(); ok {
+		return interval
+	}
+	return pb.config.PingInterval
+}
+
 func StartServer(vshost string, me string, term <-chan interface{}) *PBServer {
+	return StartServerWithConfig(vshost, me, Config{}, term)
+}
+
+func StartServerWithConfig(vshost string, me string, cfg Config, term <-chan interface{}) *PBServer {
+	return StartReplicatedServer([]string{vshost}, me, cfg, term)
+}
+
+// StartServerWithConfig, for a viewservice replicated across
+// vshosts; the server pings whichever peer answers.
+func StartReplicatedServer(vshosts []string, me string, cfg Config, term <-chan interface{}) *PBServer {
 	pb := new(PBServer)
 	pb.dead = term
 	pb.me = me
-	pb.vs = viewservice.MakeClerk(me, vshost)
+	pb.config = cfg
+	if pb.config.PingInterval <= 0 {
+		pb.config.PingInterval = viewservice.PingInterval
+	}
+	if pb.config.SnapshotEvery <= 0 {
+		pb.config.SnapshotEvery = DefaultSnapshotEvery
+	}
+	if pb.config.PushChunkBytes <= 0 {
+		pb.config.PushChunkBytes = DefaultPushChunkBytes
+	}
+	if pb.config.SessionTimeout <= 0 {
+		pb.config.SessionTimeout = DefaultSessionTimeout
+	}
+	pb.vs = viewservice.MakeReplicatedClerk(me, vshosts)
 	pb.initImpl()
 
 	rpcs := rpc.NewServer()
 	rpcs.Register(pb)
 
-	os.Remove(pb.me)
-	l, e := net.Listen("unix", pb.me)
+	l, e := transport.Listen(pb.me)
 	if e != nil {
 		log.Fatal("listen error: ", e)
 	}
@@ -96,16 +158,17 @@ func StartServer(vshost string, me string, term <-chan interface{}) *PBServer {
 				continue
 			}
 			// Will an unreliable network cause the response to fail?
-			if pb.isunreliable() && (rand.Int63()%1000) < 200 {
-				// yes: close file descriptor over which response will be sent
-				c1 := conn.(*net.UnixConn)
-				f, _ := c1.File()
-				err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-				if err != nil {
-					fmt.Printf("shutdown: %v\n", err)
+			dropReply := pb.isunreliable() && (rand.Int63()%1000) < 200
+			go func() {
+				if dropReply {
+					// yes: shut down the side over which the response will be sent
+					err := transport.CloseWrite(conn)
+					if err != nil {
+						fmt.Printf("shutdown: %v\n", err)
+					}
 				}
-			}
-			go rpcs.ServeConn(conn)
+				rpcs.ServeConn(conn)
+			}()
 		}
 	}()
 
@@ -113,7 +176,7 @@ func StartServer(vshost string, me string, term <-chan interface{}) *PBServer {
 		for pb.isdead() == false {
 			// log.Println("Ticking on", pb.me)
 			pb.tick()
-			time.Sleep(viewservice.PingInterval)
+			time.Sleep(pb.pingInterval())
 		}
 	}()
 
@@ -2,6 +2,9 @@ package pbservice
 
 import (
 	"log"
+	"sort"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"umich.edu/eecs491/proj2/viewservice"
@@ -11,39 +14,410 @@ import (
 type PBServerImpl struct {
 	currentView viewservice.View
 	// channels for the goroutine
-	operator chan Operation
-	ticker   chan struct{}
-	pusher   chan Push
-	end      chan interface{}
+	operator  chan Operation
+	ticker    chan struct{}
+	pusher    chan Push
+	watcher   chan Watcher
+	forwarder chan Forwarded
+	digester  chan chan DigestReply
+	end       chan interface{}
 }
 
+// most client ops the primary forwards to the backups at once.
+const maxForwardBatch = 64
+
 type Operation struct {
 	args    OpArgs
 	replyCh chan OpReply
 }
 
+type Forwarded struct {
+	args    ForwardArgs
+	replyCh chan ForwardReply
+}
+
 type Push struct {
 	args    PushArgs
 	replyCh chan PushReply
 }
 
+type Watcher struct {
+	args     WatchArgs
+	deadline time.Time
+	replyCh  chan WatchReply // buffered, so runServer never waits
+}
+
 
 func (pb *PBServer) runServer() {
 	database := make(map[string]string)
 	opcache := make(map[string]Result)
+	// every write bumps revision, and the key's version becomes
+	// the new revision, so a key's versions only ever go up,
+	// even across a Delete.
+	versions := make(map[string]int64)
+	revision := int64(0)
+	// when each key with a TTL runs out, in UnixNano by the
+	// primary's clock.
+	expires := make(map[string]int64)
+	sessions := make(sessionTable)
+	var index keyIndex
+	sums := newDigest()
+	var events eventLog
+	waiters := []Watcher{}
+	// the push being gathered up from its chunks (staged.Chunk
+	// counts them), and the last one installed.
+	var staged PushArgs
+	installed := ""
+	// the copy of the state in Config.DataDir, if any.
+	var disk *wal
+	// until when the viewservice won't choose another primary,
+	// so that this one can answer Gets without the backups.
+	var leaseUntil time.Time
 	pb.impl.currentView = viewservice.View{Viewnum: 0, Primary: "", Backup: ""}
 
+	// set key to value, to expire at expiresAt (0 for never).
+	Write := func(op Op, key string, value string, expiresAt int64) {
+		revision++
+		if old, exists := database[key]; !exists {
+			index.insert(key)
+		} else {
+			sums.toggleKey(key, old, versions[key], expires[key])
+		}
+		database[key] = value
+		versions[key] = revision
+		if expiresAt != 0 {
+			expires[key] = expiresAt
+		} else {
+			delete(expires, key)
+		}
+		sums.toggleKey(key, value, revision, expiresAt)
+		events.add(Event{Revision: revision, Op: op, Key: key, Value: value})
+	}
+
+	Remove := func(op Op, key string) {
+		revision++
+		if old, exists := database[key]; exists {
+			sums.toggleKey(key, old, versions[key], expires[key])
+		}
+		index.remove(key)
+		delete(database, key)
+		delete(versions, key)
+		delete(expires, key)
+		events.add(Event{Revision: revision, Op: op, Key: key})
+	}
+
+	// answer the watchers that have something to hear, or have
+	// waited long enough.
+	Notify := func() {
+		now := time.Now()
+		waiting := []Watcher{}
+		for _, w := range waiters {
+			var reply WatchReply
+			reply.Err = OK
+			reply.Revision = revision
+			found, ok := events.since(w.args, revision)
+			if !ok {
+				reply.Err = ErrCompacted
+			} else if len(found) == 0 && now.Before(w.deadline) {
+				waiting = append(waiting, w)
+				continue
+			}
+			reply.Events = found
+			w.replyCh <- reply
+		}
+		waiters = waiting
+	}
+
+	// the whole state, as pushed to backups and snapshotted.
+	State := func() PushArgs {
+		return PushArgs{View: pb.impl.currentView, KVStore: database, OpCache: opcache,
+			Versions: versions, Revision: revision, Expires: expires,
+			Events: events.events, Sessions: sessions}
+	}
+
+	// replace the whole state. empty maps may arrive as nil.
+	Install := func(state PushArgs) {
+		database = state.KVStore
+		opcache = state.OpCache
+		versions = state.Versions
+		revision = state.Revision
+		expires = state.Expires
+		sessions = state.Sessions
+		if database == nil {
+			database = make(map[string]string)
+		}
+		if opcache == nil {
+			opcache = make(map[string]Result)
+		}
+		if versions == nil {
+			versions = make(map[string]int64)
+		}
+		if expires == nil {
+			expires = make(map[string]int64)
+		}
+		if sessions == nil {
+			sessions = make(sessionTable)
+		}
+		index.rebuild(database)
+		sums.rebuild(database, versions, expires, opcache)
+		events = eventLog{events: state.Events}
+	}
+
+	Cache := func(client string, r Result) {
+		if old, exists := opcache[client]; exists {
+			sums.toggleClient(client, old)
+		}
+		opcache[client] = r
+		sums.toggleClient(client, r)
+	}
+
+	// remember the reply to a client's op, and forget the ones
+	// the client says it already has.
+	Record := func(args OpArgs, reply OpReply) {
+		r, exists := opcache[args.Client]
+		if exists {
+			sums.toggleClient(args.Client, r)
+		}
+		if r.Done == nil {
+			r.Done = make(map[int]OpReply)
+		}
+		r.Done[args.SeqNo] = reply
+		if args.Acked > r.Acked {
+			r.Acked = args.Acked
+			for seqno := range r.Done {
+				if seqno <= r.Acked {
+					delete(r.Done, seqno)
+				}
+			}
+		}
+		opcache[args.Client] = r
+		sums.toggleClient(args.Client, r)
+	}
+
+	// forget a client's session, and with it its opcache entry.
+	EndSession := func(client string) {
+		delete(sessions, client)
+		if r, exists := opcache[client]; exists {
+			sums.toggleClient(client, r)
+			delete(opcache, client)
+		}
+	}
+
+	// replace the buckets of the state that a partial push
+	// carries, keeping the rest.
+	Patch := func(state PushArgs) {
+		if len(state.KeyBuckets) > 0 {
+			keys := bucketSet(state.KeyBuckets)
+			for key, value := range database {
+				if keys[bucketOf(key)] {
+					sums.toggleKey(key, value, versions[key], expires[key])
+					delete(database, key)
+					delete(versions, key)
+					delete(expires, key)
+				}
+			}
+			for key, value := range state.KVStore {
+				database[key] = value
+				versions[key] = state.Versions[key]
+				if exp, ok := state.Expires[key]; ok {
+					expires[key] = exp
+				}
+				sums.toggleKey(key, value, versions[key], expires[key])
+			}
+			index.rebuild(database)
+		}
+		clients := bucketSet(state.ClientBuckets)
+		for client, r := range opcache {
+			if clients[bucketOf(client)] {
+				sums.toggleClient(client, r)
+				delete(opcache, client)
+			}
+		}
+		for client, r := range state.OpCache {
+			Cache(client, r)
+		}
+		revision = state.Revision
+		events = eventLog{events: state.Events}
+		sessions = state.Sessions
+		if sessions == nil {
+			sessions = make(sessionTable)
+		}
+	}
+
+	Snapshot := func() {
+		if err := disk.snapshot(State()); err != nil {
+			log.Fatal("pbservice snapshot: ", err)
+		}
+	}
+
+	// log an op that has just been applied, before anyone is
+	// told about it. reads need not be logged.
+	Persist := func(args OpArgs) {
+		if disk == nil || readOnly(args.Op) {
+			return
+		}
+		if err := disk.append(args); err != nil {
+			log.Fatal("pbservice log: ", err)
+		}
+		if disk.since >= pb.config.SnapshotEvery {
+			Snapshot()
+		}
+	}
+
+	// tell every watcher to go find the new primary.
+	DropWatchers := func() {
+		for _, w := range waiters {
+			w.replyCh <- WatchReply{Err: ErrWrongServer}
+		}
+		waiters = []Watcher{}
+	}
+
+	// apply an operation to the local state.
+	var Apply func(args OpArgs) OpReply
+	Apply = func(args OpArgs) OpReply {
+		var reply OpReply
+		reply.Err = OK
+		if _, ok := sessions[args.Client]; ok && args.Session && args.SessionExpires != 0 {
+			sessions[args.Client] = args.SessionExpires
+		}
+		switch args.Op {
+		case "Batch":
+			// all or nothing: check everything first.
+			for _, op := range args.Ops {
+				if !batchable(op.Op) {
+					reply.Err = "UnknownOp"
+					return reply
+				}
+			}
+			for _, guard := range args.Guards {
+				if !guard.Holds(database, versions) {
+					return reply
+				}
+			}
+			reply.Applied = true
+			for _, op := range args.Ops {
+				reply.Results = append(reply.Results, Apply(op))
+			}
+			return reply
+		case "Put":
+			Write(args.Op, args.Key, args.Value, args.Expires)
+		case "Append":
+			expiresAt := args.Expires
+			if expiresAt == 0 {
+				expiresAt = expires[args.Key]
+			}
+			Write(args.Op, args.Key, database[args.Key]+args.Value, expiresAt)
+		case "Delete":
+			Remove(args.Op, args.Key)
+		case "Expire":
+			// stale if the key has been written since the
+			// primary decided to expire it.
+			if exp, ok := expires[args.Key]; ok && exp == args.Expires {
+				Remove(args.Op, args.Key)
+			}
+		case "Register":
+			sessions[args.Client] = args.SessionExpires
+		case "KeepAlive":
+			if _, ok := sessions[args.Client]; !ok {
+				reply.Err = ErrSessionExpired
+			}
+		case "Close":
+			EndSession(args.Client)
+		case "EndSession":
+			// stale if the session has been used since the
+			// primary decided to end it.
+			if exp, ok := sessions[args.Key]; ok && exp == args.Expires {
+				EndSession(args.Key)
+			}
+		case "CompareAndSwap":
+			val, exists := database[args.Key]
+			if exists && val == args.Expected {
+				Write(args.Op, args.Key, args.Value, args.Expires)
+				reply.Applied = true
+			}
+			reply.Value = val
+		case "PutIfAbsent":
+			val, exists := database[args.Key]
+			if !exists {
+				Write(args.Op, args.Key, args.Value, args.Expires)
+				reply.Applied = true
+			}
+			reply.Value = val
+		case "PutIfVersion":
+			val := database[args.Key]
+			if versions[args.Key] == args.Version {
+				Write(args.Op, args.Key, args.Value, args.Expires)
+				reply.Applied = true
+			}
+			reply.Value = val
+		case "Increment":
+			// a missing key counts as 0.
+			val, exists := database[args.Key]
+			n := int64(0)
+			if exists {
+				var err error
+				n, err = strconv.ParseInt(val, 10, 64)
+				if err != nil {
+					reply.Err = ErrNotNumeric
+					reply.Value = val
+					break
+				}
+			}
+			sum := n + args.Delta
+			if (args.Delta > 0 && sum < n) || (args.Delta < 0 && sum > n) {
+				reply.Err = ErrOverflow
+				reply.Value = val
+				break
+			}
+			expiresAt := args.Expires
+			if expiresAt == 0 {
+				expiresAt = expires[args.Key]
+			}
+			Write(args.Op, args.Key, strconv.FormatInt(sum, 10), expiresAt)
+			reply.Value = database[args.Key]
+		case "Scan":
+			limit := args.Limit
+			if limit <= 0 {
+				limit = DefaultScanLimit
+			}
+			if limit > MaxScanLimit {
+				limit = MaxScanLimit
+			}
+			keys, cursor := index.scan(args.Key, args.End, limit)
+			for _, key := range keys {
+				reply.Entries = append(reply.Entries,
+					KeyValue{Key: key, Value: database[key], Version: versions[key]})
+			}
+			reply.Cursor = cursor
+		case "Get":
+			val, exists := database[args.Key]
+			if !exists {
+				reply.Err = ErrNoKey
+			}
+			log.Println("Get value", val)
+			reply.Value = val
+		default:
+			reply.Err = "UnknownOp"
+		}
+		reply.Version = versions[args.Key]
+		return reply
+	}
+
 	NeedForward := func() bool {
-		return pb.impl.currentView.Primary == pb.me && pb.impl.currentView.Backup != ""
+		return pb.impl.currentView.Primary == pb.me && len(pb.impl.currentView.Backups) > 0
 	}
 
 	NeedPush := func(latestView viewservice.View) bool {
-		// Case A: New backup
-		// Case B: Same backup, but backup has restarted and lost state
-		// Case C: Backup promoted to primary and new backup
-		return (pb.impl.currentView.Primary == pb.me && latestView.Backup != pb.impl.currentView.Backup) ||
-			(pb.impl.currentView.Primary == pb.me && latestView.Backup == pb.impl.currentView.Backup && pb.impl.currentView.Viewnum != latestView.Viewnum) ||
-			(pb.impl.currentView.Backup == pb.me && latestView.Primary == pb.me && latestView.Backup != "")
+		// Case A: New backups
+		// Case B: Same backups, but one may have restarted and lost state
+		// Case C: Backup promoted to primary, remaining/new backups
+		// Case D: we have just started, perhaps on state from
+		// DataDir, and made primary straight away; the backups'
+		// state may differ from ours
+		return latestView.Primary == pb.me && len(latestView.Backups) > 0 &&
+			latestView.Viewnum != pb.impl.currentView.Viewnum &&
+			(pb.impl.currentView.Primary == pb.me || pb.impl.currentView.IsBackup(pb.me) ||
+				pb.impl.currentView.Viewnum == 0)
 	}
 
 	WrongServerOp := func(args OpArgs) bool {
@@ -51,8 +425,62 @@ func (pb *PBServer) runServer() {
 			(args.Source != args.Client && args.Source != pb.impl.currentView.Primary)
 	}
 
+	// bring backup up to date, until it takes the push or the
+	// viewservice drops it from the view. only the buckets that
+	// differ from what backup says it has are sent, a chunk at
+	// a time.
+	PushTo := func(backup string, latestView viewservice.View) bool {
+		for {
+			pargs := State()
+			pargs.View = latestView
+			var digestReply DigestReply
+			if call(backup, "PBServer.Digest", DigestArgs{}, &digestReply) && digestReply.Err == OK {
+				pargs.Partial = true
+				pargs.KeyBuckets, pargs.ClientBuckets =
+					sums.diff(digest{Keys: digestReply.Keys, Clients: digestReply.Clients})
+			}
+			src := newPushSource(pargs, index.keys, pb.config.PushChunkBytes)
+			transfer := pb.me + "@" + strconv.FormatInt(time.Now().UnixNano(), 10)
+			if pargs.Partial {
+				log.Printf("Pushing %v of %v key buckets to %v\n",
+					len(pargs.KeyBuckets), digestBuckets, backup)
+			} else {
+				log.Printf("Pushing %v keys and %v clients to %v\n",
+					len(pargs.KVStore), len(pargs.OpCache), backup)
+			}
+			next := 0
+			for {
+				chunk := src.chunk(next)
+				chunk.Transfer = transfer
+				chunk.Chunk = next
+				var pushReply PushReply
+				if call(backup, "PBServer.Push", chunk, &pushReply) {
+					if pushReply.Next == 0 {
+						// backup has lost the transfer, and
+						// perhaps what it had; start over.
+						break
+					}
+					if chunk.Last && pushReply.Next > next {
+						return true
+					}
+					next = pushReply.Next
+					continue
+				}
+				log.Println("Push failed")
+				newView, err := pb.vs.Ping(pb.impl.currentView.Viewnum)
+				if err == nil && !newView.IsBackup(backup) {
+					return false
+				}
+				time.Sleep(pb.pingInterval())
+			}
+		}
+	}
+
 	UpdateView := func() {
-		latestView, err := pb.vs.Ping(pb.impl.currentView.Viewnum)
+		// the lease runs from before the Ping was sent, so it
+		// ends no later than the viewservice thinks it does.
+		start := time.Now()
+		latestView, lease, err := pb.vs.PingLease(pb.impl.currentView.Viewnum)
 		if latestView.Viewnum != pb.impl.currentView.Viewnum {
 			// log.Println("Old view: ", pb.impl.currentView)
 			// log.Println("New view: ", latestView)
@@ -62,137 +490,406 @@ func (pb *PBServer) runServer() {
 			return
 		}
 		if NeedPush(latestView) {
-			pushRetryNeeded := true
-			pb.impl.currentView = latestView
-
-			for pushRetryNeeded {
-				pargs := PushArgs{View: latestView, KVStore: database, OpCache: opcache}
-				var pushReply PushReply
-				log.Println("Pushing database")
-				for k, v := range database {
-					log.Println(k, v)
+			for _, backup := range latestView.Backups {
+				if !PushTo(backup, latestView) {
+					// the view has moved on; don't ack this
+					// one, and push again on the next tick.
+					return
 				}
-				ok := call(pb.impl.currentView.Backup, "PBServer.Push", pargs, &pushReply)
-				if ok {
-					pushRetryNeeded = false
-					break
+			}
+		}
+		pb.impl.currentView = latestView
+		if lease > 0 {
+			leaseUntil = start.Add(lease)
+		}
+		// log.Println("Current view: ", pb.impl.currentView)
+	}
+
+	// can a Get be answered from the local state alone? only if
+	// no other server can have become primary and taken writes.
+	Leased := func() bool {
+		return pb.impl.currentView.Primary == pb.me && time.Now().Before(leaseUntil)
+	}
+
+	// send operations to every backup, to apply in order. if the
+	// view changes along the way, the backups may have been
+	// re-pushed, so start again; they drop duplicates through
+	// opcache.
+	Forward := func(ops []OpArgs) OpReply {
+		fargs := ForwardArgs{Ops: make([]OpArgs, len(ops))}
+		for i, args := range ops {
+			fargs.Ops[i] = args
+			fargs.Ops[i].Source = pb.me
+		}
+		var forwardReply OpReply
+		forwardReply.Err = OK
+		done := make(map[string]bool)
+		viewnum := pb.impl.currentView.Viewnum
+		for NeedForward() {
+			if pb.impl.currentView.Viewnum != viewnum {
+				viewnum = pb.impl.currentView.Viewnum
+				done = make(map[string]bool)
+			}
+			pending := false
+			for _, backup := range pb.impl.currentView.Backups {
+				if done[backup] {
+					continue
 				}
+				var reply ForwardReply
+				ok := call(backup, "PBServer.Forward", fargs, &reply)
+				// log.Println("Forward reply: ", reply)
 				if !ok {
-					log.Println("Push failed")
+					log.Println("Forward failed, retrying")
+					pending = true
+					continue
 				}
-				latestView, err := pb.vs.Ping(pb.impl.currentView.Viewnum)
-				if err != nil {
-					pb.impl.currentView = latestView
+				if reply.Err == ErrWrongServer {
+					forwardReply.Err = ErrWrongServer
+					return forwardReply
 				}
-				if pb.impl.currentView.Backup == "" {
-					pushRetryNeeded = false
+				done[backup] = true
+			}
+			if !pending {
+				break
+			}
+
+			// Refresh view
+			UpdateView()
+			time.Sleep(pb.pingInterval())
+		}
+		if pb.impl.currentView.Primary != pb.me {
+			forwardReply.Err = ErrWrongServer
+		}
+		return forwardReply
+	}
+
+	// on the primary, remove key if its TTL has run out. the
+	// backups are told with an Expire op, so they delete it at
+	// the same point. returns false if we turn out not to be
+	// the primary.
+	ExpireIfDue := func(key string, now time.Time) bool {
+		exp, ok := expires[key]
+		if !ok || now.UnixNano() < exp {
+			return true
+		}
+		eargs := OpArgs{Op: EXPIRE, Key: key, Expires: exp, Client: pb.me, Source: pb.me}
+		if NeedForward() && Forward([]OpArgs{eargs}).Err == ErrWrongServer {
+			return false
+		}
+		Apply(eargs)
+		Persist(eargs)
+		return true
+	}
+
+	// on the primary, end client's session if it has timed out,
+	// as ExpireIfDue does for keys.
+	EndSessionIfDue := func(client string, now time.Time) bool {
+		exp, ok := sessions[client]
+		if !ok || now.UnixNano() < exp {
+			return true
+		}
+		eargs := OpArgs{Op: ENDSESSION, Key: client, Expires: exp, Client: pb.me, Source: pb.me}
+		if NeedForward() && Forward([]OpArgs{eargs}).Err == ErrWrongServer {
+			return false
+		}
+		Apply(eargs)
+		Persist(eargs)
+		return true
+	}
+
+	// decide whether to take an op: turn away repeats and ops
+	// this server shouldn't take, and, on the primary, expire
+	// what is due and stamp the op. returns the op to apply, or
+	// false and the reply to send instead.
+	Admit := func(args OpArgs) (OpArgs, OpReply, bool) {
+		// log.Println("Operation called: ", args.Source, args.Op, args.Key, args.Value, args.Client, args.SeqNo)
+		// log.Println("My view: ", pb.impl.currentView, pb.me)
+		var operationReply OpReply
+		operationReply.Err = OK
+		if r, exists := opcache[args.Client]; exists && !uncached(args.Op) {
+			if reply, done := r.Done[args.SeqNo]; done {
+				// log.Println("Duplicate operation from client", args.Client, args.SeqNo)
+				return args, reply, false
+			}
+			if args.SeqNo <= r.Acked {
+				// the client already has the reply, and
+				// won't look at this one.
+				return args, operationReply, false
+			}
+		}
+		if WrongServerOp(args) {
+			log.Println("WrongServerOp", args.Source, args.Op, args.Key, args.Value, args.Client, args.SeqNo)
+			operationReply.Err = ErrWrongServer
+			return args, operationReply, false
+		}
+
+		// the primary decides when keys expire, and stamps
+		// TTLs with its own clock before forwarding.
+		if pb.impl.currentView.Primary == pb.me {
+			if args.Op == EXPIRE || args.Op == ENDSESSION {
+				operationReply.Err = "UnknownOp"
+				return args, operationReply, false
+			}
+			now := time.Now()
+			if args.Session {
+				if !EndSessionIfDue(args.Client, now) {
+					operationReply.Err = ErrWrongServer
+					return args, operationReply, false
 				}
-				time.Sleep(viewservice.PingInterval)
+				if _, ok := sessions[args.Client]; !ok && args.Op != REGISTER {
+					operationReply.Err = ErrSessionExpired
+					return args, operationReply, false
+				}
+				args.SessionExpires = now.Add(pb.config.SessionTimeout).UnixNano()
+			}
+			keys := args.Keys()
+			if args.Op == SCAN {
+				// any key in the range could be due.
+				keys = []string{}
+				for key := range expires {
+					if key >= args.Key && (args.End == "" || key < args.End) {
+						keys = append(keys, key)
+					}
+				}
+				sort.Strings(keys)
+			}
+			expired := true
+			for _, key := range keys {
+				expired = expired && ExpireIfDue(key, now)
 			}
+			if !expired {
+				operationReply.Err = ErrWrongServer
+				return args, operationReply, false
+			}
+			args = args.Stamped(now)
+		}
+		return args, operationReply, true
+	}
 
-		} else {
-			pb.impl.currentView = latestView
+	// apply an admitted op, and remember its reply.
+	Execute := func(args OpArgs) OpReply {
+		operationReply := Apply(args)
+		Persist(args)
+		if uncached(args.Op) {
+			return operationReply
 		}
-		// log.Println("Current view: ", pb.impl.currentView)
+		if args.Op == REGISTER {
+			operationReply.SessionTimeout = pb.config.SessionTimeout
+		}
+		Record(args, operationReply)
+		return operationReply
+	}
+
+	if pb.config.DataDir != "" {
+		var snap snapshot
+		var records []walRecord
+		var err error
+		disk, snap, records, err = openWAL(pb.config.DataDir)
+		if err != nil {
+			log.Fatal("pbservice data: ", err)
+		}
+		Install(snap.State)
+		for _, rec := range records {
+			reply := Apply(rec.Args)
+			if !uncached(rec.Args.Op) {
+				Record(rec.Args, reply)
+			}
+		}
+		log.Printf("PBServer(%v) recovered %v keys at revision %v from %v (%v ops after the snapshot)\n",
+			pb.me, len(database), revision, pb.config.DataDir, len(records))
 	}
 
 	for {
 		// log.Println("Waiting for operation on", pb.me)
 		select {
 		case operation := <-pb.impl.operator:
-			// log.Println("Operation received on", pb.me, "current database:")
-			// for k, v := range database {
-			// 	log.Println(k, v)
-			// }
-			args := operation.args
-			// log.Println("Operation called: ", args.Source, args.Op, args.Key, args.Value, args.Client, args.SeqNo)
-			// log.Println("My view: ", pb.impl.currentView, pb.me)
-
-			if _, exists := opcache[args.Client]; exists && args.SeqNo <= opcache[args.Client].SeqNo {
-				// log.Println("Duplicate operation from client", args.Client, args.SeqNo)
-				operation.replyCh <- opcache[args.Client].V
-				continue
+			// take the ops that are waiting along with this one, so
+			// that they go to the backups in one forward.
+			operations := []Operation{operation}
+			for more := true; more && len(operations) < maxForwardBatch; {
+				select {
+				case op := <-pb.impl.operator:
+					operations = append(operations, op)
+				default:
+					more = false
+				}
 			}
-			// This is the new, single point for all client operations.
-			var operationReply OpReply
-			operationReply.Err = OK
-			// 1) Print debug logs (moved from Operation())
-			// log.Printf("Operation called by %s for %s key=%s val=%s; current P=%s B=%s\n",
-			// 	args.Source, args.Op, args.Key, args.Value,
-			// 	pb.impl.currentView.Primary, pb.impl.currentView.Backup)
-			//log.Println("I'm", pb.me)
-			if WrongServerOp(args) {
-				log.Println("WrongServerOp", args.Source, args.Op, args.Key, args.Value, args.Client, args.SeqNo)
-				operationReply.Err = ErrWrongServer
-				operation.replyCh <- operationReply
+
+			// the ops to apply, in order, and who is waiting for
+			// each; a retry that arrives alongside its first try
+			// waits for the same reply.
+			admitted := []OpArgs{}
+			replyTo := [][]chan OpReply{}
+			first := make(map[string]int)
+			viewnum := pb.impl.currentView.Viewnum
+			for _, operation := range operations {
+				id := operation.args.Client + "/" + strconv.Itoa(operation.args.SeqNo)
+				if i, ok := first[id]; ok && !uncached(operation.args.Op) {
+					replyTo[i] = append(replyTo[i], operation.replyCh)
+					continue
+				}
+				args, operationReply, ok := Admit(operation.args)
+				if !ok {
+					operation.replyCh <- operationReply
+					continue
+				}
+				first[id] = len(admitted)
+				admitted = append(admitted, args)
+				replyTo = append(replyTo, []chan OpReply{operation.replyCh})
+			}
+			if len(admitted) == 0 {
 				continue
 			}
 
-			// 2) Possibly forward to backup
-			var forwardReply OpReply
-
-			if NeedForward() {
-				// log.Println("About to forward, I'm", pb.me)
-				fargs := args
-				fargs.Source = pb.me
-				retryNeeded := true
-				for retryNeeded {
-					ok := call(pb.impl.currentView.Backup, "PBServer.Operation", fargs, &forwardReply)
-					// log.Println("Forward reply: ", forwardReply)
-					if ok {
-						retryNeeded = false
-						break
-					} else if !ok {
-						log.Println("Forward failed, retrying")
+			// while the lease holds, the backups needn't see reads.
+			local := Leased()
+			forward := admitted
+			if local {
+				forward = []OpArgs{}
+				for _, args := range admitted {
+					if !readOnly(args.Op) {
+						forward = append(forward, args)
 					}
-
-					// Refresh view
-					UpdateView()
-					time.Sleep(viewservice.PingInterval)
 				}
 			}
 
-			// 3) Check if error from forwarding
-			if forwardReply.Err == ErrWrongServer {
-				log.Println("WrongServerOp", args.Source, args.Op, args.Key, args.Value, args.Client, args.SeqNo)
-				operationReply.Err = ErrWrongServer
-				operation.replyCh <- operationReply
+			// expiring what a later op touches may have moved us to
+			// a new view, in which the ops admitted before it were
+			// never checked, and perhaps not ours to take.
+			moved := pb.impl.currentView.Viewnum != viewnum
+
+			// Possibly forward to backups, and check for an error
+			if moved || (NeedForward() && len(forward) > 0 && Forward(forward).Err == ErrWrongServer) {
+				log.Println("WrongServerOp: forward of", len(admitted), "ops")
+				for _, chans := range replyTo {
+					for _, replyCh := range chans {
+						replyCh <- OpReply{Err: ErrWrongServer}
+					}
+				}
 				continue
 			}
 
-			// Apply the operation locally
-			switch args.Op {
-			case "Put":
-				database[args.Key] = args.Value
-			case "Append":
-				database[args.Key] += args.Value
-			case "Get":
-				val := database[args.Key]
-				log.Println("Get value", val)
-				operationReply.Value = val
-			default:
-				operationReply.Err = "UnknownOp"
+			// Apply the operations locally
+			for i, args := range admitted {
+				var operationReply OpReply
+				if !local || !readOnly(args.Op) {
+					operationReply = Execute(args)
+				} else if Leased() {
+					// not recorded, so that the opcache stays
+					// the same as the backups'; a retry just
+					// reads again.
+					args.SessionExpires = 0
+					operationReply = Apply(args)
+				} else {
+					// the lease ran out while forwarding the rest.
+					operationReply = OpReply{Err: ErrWrongServer}
+				}
+				for _, replyCh := range replyTo[i] {
+					replyCh <- operationReply
+				}
+			}
+			Notify()
+
+		case fwd := <-pb.impl.forwarder:
+			// ops from the primary, to apply in the order sent.
+			var forwardReply ForwardReply
+			forwardReply.Err = OK
+			for _, args := range fwd.args.Ops {
+				args, operationReply, ok := Admit(args)
+				if ok {
+					Execute(args)
+				} else if operationReply.Err == ErrWrongServer {
+					forwardReply.Err = ErrWrongServer
+					break
+				}
 			}
+			fwd.replyCh <- forwardReply
 
-			opcache[args.Client] = Result{SeqNo: args.SeqNo, V: operationReply}
-			operation.replyCh <- operationReply
+		case w := <-pb.impl.watcher:
+			if pb.impl.currentView.Primary != pb.me {
+				w.replyCh <- WatchReply{Err: ErrWrongServer}
+				continue
+			}
+			if w.args.AfterRevision < 0 {
+				w.args.AfterRevision = revision
+			}
+			waiters = append(waiters, w)
+			Notify()
 
 		case <-pb.impl.ticker:
 			// log.Println("Received tick")
 			UpdateView()
+			if pb.impl.currentView.Primary == pb.me {
+				now := time.Now()
+				due := []string{}
+				for key, exp := range expires {
+					if now.UnixNano() >= exp {
+						due = append(due, key)
+					}
+				}
+				sort.Strings(due)
+				for _, key := range due {
+					if !ExpireIfDue(key, now) {
+						break
+					}
+				}
+				for _, client := range sessions.due(now) {
+					if !EndSessionIfDue(client, now) {
+						break
+					}
+				}
+			}
+			if pb.impl.currentView.Primary == pb.me {
+				Notify()
+			} else {
+				DropWatchers()
+			}
+
+		case replyCh := <-pb.impl.digester:
+			replyCh <- DigestReply{Err: OK,
+				Keys:    append([]uint64(nil), sums.Keys...),
+				Clients: append([]uint64(nil), sums.Clients...)}
 
 		case push := <-pb.impl.pusher:
 			var pushReply PushReply
-			log.Println("Pulling on backup")
-			database = push.args.KVStore
-			opcache = push.args.OpCache
-			log.Println("Printing database:")
-			for k, v := range database {
-				log.Println("ABC")
-				log.Println(k, v)
-			}
-			pb.impl.currentView = push.args.View
 			pushReply.Err = OK
+			chunk := push.args
+			if chunk.Transfer == installed {
+				// a retry of the last chunk
+				pushReply.Next = chunk.Chunk + 1
+				push.replyCh <- pushReply
+				continue
+			}
+			if chunk.Transfer != staged.Transfer {
+				staged = PushArgs{Transfer: chunk.Transfer}
+			}
+			if chunk.Chunk != staged.Chunk {
+				// a repeat, or one we can't take yet.
+				pushReply.Next = staged.Chunk
+				push.replyCh <- pushReply
+				continue
+			}
+			staged.merge(chunk)
+			staged.Chunk++
+			pushReply.Next = staged.Chunk
+			if !chunk.Last {
+				push.replyCh <- pushReply
+				continue
+			}
+
+			log.Println("Pulling on backup")
+			if staged.Partial {
+				Patch(staged)
+			} else {
+				Install(staged)
+			}
+			installed = staged.Transfer
+			staged = PushArgs{}
+			if disk != nil {
+				Snapshot()
+			}
+			DropWatchers()
+			pb.impl.currentView = chunk.View
 			push.replyCh <- pushReply
 		}
 	}
@@ -204,6 +901,9 @@ func (pb *PBServer) initImpl() {
 	pb.impl.operator = make(chan Operation)
 	pb.impl.ticker = make(chan struct{})
 	pb.impl.pusher = make(chan Push)
+	pb.impl.watcher = make(chan Watcher)
+	pb.impl.forwarder = make(chan Forwarded)
+	pb.impl.digester = make(chan chan DigestReply)
 	pb.impl.end = make(chan interface{})
 
 	// Start the goroutine
@@ -228,6 +928,45 @@ func (pb *PBServer) Operation(args OpArgs, reply *OpReply) error {
 	return nil
 }
 
+// server Forward() RPC handler
+func (pb *PBServer) Forward(args ForwardArgs, reply *ForwardReply) error {
+	fwd := Forwarded{
+		args:    args,
+		replyCh: make(chan ForwardReply),
+	}
+	atomic.AddInt32(&pb.forwards, 1)
+	pb.impl.forwarder <- fwd
+	*reply = <-fwd.replyCh
+	return nil
+}
+
+// server Watch() RPC handler
+func (pb *PBServer) Watch(args WatchArgs, reply *WatchReply) error {
+	timeout := args.Timeout
+	if timeout == 0 {
+		timeout = defaultWatchTimeout
+	}
+	if timeout > maxWatchTimeout {
+		timeout = maxWatchTimeout
+	}
+	w := Watcher{
+		args:     args,
+		deadline: time.Now().Add(timeout),
+		replyCh:  make(chan WatchReply, 1),
+	}
+	pb.impl.watcher <- w
+	*reply = <-w.replyCh
+	return nil
+}
+
+// server Digest() RPC handler
+func (pb *PBServer) Digest(args DigestArgs, reply *DigestReply) error {
+	replyCh := make(chan DigestReply)
+	pb.impl.digester <- replyCh
+	*reply = <-replyCh
+	return nil
+}
+
 // server Push() RPC handler
 func (pb *PBServer) Push(args PushArgs, reply *PushReply) error {
 	push := Push{
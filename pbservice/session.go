@@ -0,0 +1,50 @@
+package pbservice
+
+import (
+	"sort"
+	"time"
+)
+
+//
+// Client sessions, so that opcache doesn't grow forever.
+//
+// A Clerk Registers a session before its first op, marks every
+// op as belonging to it, and sends KeepAlives while it is idle.
+// The primary stamps each op with when the session will time
+// out if nothing more is heard, and, like a key's TTL, ends
+// sessions that run out by sending the backups an EndSession
+// op, so every server drops the same sessions, and their
+// opcache entries, at the same point. An op from a session that
+// has ended is refused with ErrSessionExpired rather than being
+// run again.
+//
+// Clients that never Register (the tests' hand-made RPCs, say)
+// keep their opcache entries for good, as before.
+//
+
+const DefaultSessionTimeout = time.Minute
+
+// when each client's session times out, in UnixNano.
+type sessionTable map[string]int64
+
+// the clients whose sessions have run out by now, in order.
+func (st sessionTable) due(now time.Time) []string {
+	due := []string{}
+	for client, exp := range st {
+		if now.UnixNano() >= exp {
+			due = append(due, client)
+		}
+	}
+	sort.Strings(due)
+	return due
+}
+
+// ops that are never answered from opcache, nor recorded in it.
+func uncached(op Op) bool {
+	return op == EXPIRE || op == ENDSESSION || op == KEEPALIVE || op == CLOSE
+}
+
+// ops that change nothing, so running one twice is harmless.
+func readOnly(op Op) bool {
+	return op == GET || op == SCAN
+}
@@ -0,0 +1,270 @@
+package pbservice
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+//
+// Incremental state transfer. Rather than pushing the whole
+// database to a backup, the primary first asks it for a digest
+// of what it has, and then pushes only the buckets that differ.
+//
+// Keys (and opcache clients) are hashed into a fixed number of
+// buckets. A bucket's hash is the XOR of the hashes of its
+// entries, so each server keeps its digest up to date with
+// every write in constant time, and answering for a digest does
+// not have to look at the database. An entry's hash covers its
+// value and expiry as well as its version, since two servers
+// can give the same version to different writes after a
+// failover.
+//
+
+const digestBuckets = 1024
+
+type digest struct {
+	Keys    []uint64 // per bucket of keys
+	Clients []uint64 // per bucket of opcache clients
+}
+
+func newDigest() digest {
+	return digest{Keys: make([]uint64, digestBuckets),
+		Clients: make([]uint64, digestBuckets)}
+}
+
+func bucketOf(s string) int {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return int(h.Sum32() % digestBuckets)
+}
+
+func entryHash(key string, value string, version int64, expires int64) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(value))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatInt(version, 10) + "/" + strconv.FormatInt(expires, 10)))
+	return h.Sum64()
+}
+
+func resultHash(client string, r Result) uint64 {
+	seqnos := make([]int, 0, len(r.Done))
+	for seqno := range r.Done {
+		seqnos = append(seqnos, seqno)
+	}
+	sort.Ints(seqnos)
+	h := fnv.New64a()
+	h.Write([]byte(client))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.Itoa(r.Acked)))
+	for _, seqno := range seqnos {
+		h.Write([]byte("," + strconv.Itoa(seqno)))
+	}
+	return h.Sum64()
+}
+
+// add a key's entry to the digest, or take it back out.
+func (d *digest) toggleKey(key string, value string, version int64, expires int64) {
+	d.Keys[bucketOf(key)] ^= entryHash(key, value, version, expires)
+}
+
+func (d *digest) toggleClient(client string, r Result) {
+	d.Clients[bucketOf(client)] ^= resultHash(client, r)
+}
+
+func (d *digest) rebuild(database map[string]string, versions map[string]int64,
+	expires map[string]int64, opcache map[string]Result) {
+	*d = newDigest()
+	for key, value := range database {
+		d.toggleKey(key, value, versions[key], expires[key])
+	}
+	for client, r := range opcache {
+		d.toggleClient(client, r)
+	}
+}
+
+// the buckets of keys and of clients that differ from other's.
+func (d digest) diff(other digest) (keys []int, clients []int) {
+	for i := 0; i < digestBuckets; i++ {
+		if len(other.Keys) != digestBuckets || d.Keys[i] != other.Keys[i] {
+			keys = append(keys, i)
+		}
+		if len(other.Clients) != digestBuckets || d.Clients[i] != other.Clients[i] {
+			clients = append(clients, i)
+		}
+	}
+	return keys, clients
+}
+
+func bucketSet(buckets []int) map[int]bool {
+	set := make(map[int]bool, len(buckets))
+	for _, b := range buckets {
+		set[b] = true
+	}
+	return set
+}
+
+//
+// A push is sent as a series of chunks, each holding at most
+// about Config.PushChunkBytes of keys and values, opcache
+// entries, events and sessions, all tagged with the same
+// transfer ID. The backup gathers them up and installs the new
+// state only once the last one (which also carries the view and
+// revision) has arrived. Each reply says which chunk the backup
+// wants next, so after a dropped connection the primary picks
+// up where it left off; if the backup has lost the transfer, it
+// starts over.
+//
+// The primary doesn't copy the state to push it: each chunk is
+// read out of the live state when it is sent, walking the keys
+// in index order. runServer does nothing else while it pushes,
+// so the state holds still, and any chunk already sent can be
+// read out again from where it started.
+//
+
+const DefaultPushChunkBytes = 1 << 20
+
+// where each part of a push has got to.
+type pushCursor struct {
+	Key     int
+	Client  int
+	Event   int
+	Session int
+}
+
+type pushSource struct {
+	state    PushArgs
+	keys     []string     // sorted; those outside keyBuckets are skipped
+	keySet   map[int]bool // nil for every key
+	clients  []string     // opcache clients to send, sorted
+	sessions []string     // sorted
+	limit    int
+	starts   []pushCursor // where each chunk read so far starts
+}
+
+// a push of state, in chunks of about limit bytes. keys are the
+// keys of state.KVStore, in order. a partial push sends only the
+// keys and clients in state.KeyBuckets and state.ClientBuckets.
+func newPushSource(state PushArgs, keys []string, limit int) *pushSource {
+	src := &pushSource{state: state, keys: keys, limit: limit,
+		starts: []pushCursor{{}}}
+	var clientSet map[int]bool
+	if state.Partial {
+		src.keySet = bucketSet(state.KeyBuckets)
+		clientSet = bucketSet(state.ClientBuckets)
+	}
+	for client := range state.OpCache {
+		if clientSet == nil || clientSet[bucketOf(client)] {
+			src.clients = append(src.clients, client)
+		}
+	}
+	sort.Strings(src.clients)
+	for client := range state.Sessions {
+		src.sessions = append(src.sessions, client)
+	}
+	sort.Strings(src.sessions)
+	return src
+}
+
+// chunk n of the push. the first time, chunks must be asked for
+// in order.
+func (src *pushSource) chunk(n int) PushArgs {
+	var chunk PushArgs
+	cur := src.starts[n]
+	size := 0
+	for ; cur.Key < len(src.keys) && size < src.limit; cur.Key++ {
+		key := src.keys[cur.Key]
+		if src.keySet != nil && !src.keySet[bucketOf(key)] {
+			continue
+		}
+		if chunk.KVStore == nil {
+			chunk.KVStore = make(map[string]string)
+			chunk.Versions = make(map[string]int64)
+			chunk.Expires = make(map[string]int64)
+		}
+		value := src.state.KVStore[key]
+		chunk.KVStore[key] = value
+		chunk.Versions[key] = src.state.Versions[key]
+		if exp, ok := src.state.Expires[key]; ok {
+			chunk.Expires[key] = exp
+		}
+		size += len(key) + len(value)
+	}
+	for ; cur.Client < len(src.clients) && size < src.limit; cur.Client++ {
+		client := src.clients[cur.Client]
+		if chunk.OpCache == nil {
+			chunk.OpCache = make(map[string]Result)
+		}
+		r := src.state.OpCache[client]
+		chunk.OpCache[client] = r
+		size += len(client)
+		for _, reply := range r.Done {
+			size += len(reply.Value)
+		}
+	}
+	for ; cur.Event < len(src.state.Events) && size < src.limit; cur.Event++ {
+		e := src.state.Events[cur.Event]
+		chunk.Events = append(chunk.Events, e)
+		size += len(e.Key) + len(e.Value)
+	}
+	for ; cur.Session < len(src.sessions) && size < src.limit; cur.Session++ {
+		client := src.sessions[cur.Session]
+		if chunk.Sessions == nil {
+			chunk.Sessions = make(sessionTable)
+		}
+		chunk.Sessions[client] = src.state.Sessions[client]
+		size += len(client) + 8
+	}
+	if n+1 == len(src.starts) {
+		src.starts = append(src.starts, cur)
+	}
+
+	if cur.Key == len(src.keys) && cur.Client == len(src.clients) &&
+		cur.Event == len(src.state.Events) && cur.Session == len(src.sessions) {
+		// the last chunk carries everything else.
+		chunk.View = src.state.View
+		chunk.Revision = src.state.Revision
+		chunk.Partial = src.state.Partial
+		chunk.KeyBuckets = src.state.KeyBuckets
+		chunk.ClientBuckets = src.state.ClientBuckets
+		chunk.Last = true
+	}
+	return chunk
+}
+
+// add the data in a chunk to a push being gathered up.
+func (args *PushArgs) merge(chunk PushArgs) {
+	if args.KVStore == nil {
+		args.KVStore = make(map[string]string)
+		args.Versions = make(map[string]int64)
+		args.Expires = make(map[string]int64)
+		args.OpCache = make(map[string]Result)
+	}
+	for key, value := range chunk.KVStore {
+		args.KVStore[key] = value
+		args.Versions[key] = chunk.Versions[key]
+	}
+	for key, exp := range chunk.Expires {
+		args.Expires[key] = exp
+	}
+	for client, r := range chunk.OpCache {
+		args.OpCache[client] = r
+	}
+	args.Events = append(args.Events, chunk.Events...)
+	for client, exp := range chunk.Sessions {
+		if args.Sessions == nil {
+			args.Sessions = make(sessionTable)
+		}
+		args.Sessions[client] = exp
+	}
+	if chunk.Last {
+		args.View = chunk.View
+		args.Revision = chunk.Revision
+		args.Partial = chunk.Partial
+		args.KeyBuckets = chunk.KeyBuckets
+		args.ClientBuckets = chunk.ClientBuckets
+		args.Last = true
+	}
+}
@@ -0,0 +1,160 @@
+package pbservice
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+//
+// On-disk state, for a PBServer started with Config.DataDir.
+//
+// The directory holds a snapshot of the whole state and a
+// write-ahead log of the ops applied since. Every op that may
+// change the state is appended to the log, and fsync()ed, before
+// anyone hears of it. Every Config.SnapshotEvery ops (and
+// whenever a Push replaces the state) a new snapshot is written
+// and the log is emptied.
+//
+// Each log record is numbered, and the snapshot remembers the
+// number of the last record it includes, so a crash between
+// writing a snapshot and emptying the log does not apply any op
+// twice on recovery. As in the viewservice's view log, a torn
+// last record is cut off.
+//
+
+const (
+	snapshotFile = "snapshot.json"
+	walFile      = "wal.log"
+)
+
+// default number of logged ops between snapshots.
+const DefaultSnapshotEvery = 1000
+
+type walRecord struct {
+	Index int64
+	Args  OpArgs
+}
+
+type snapshot struct {
+	Index int64    // last log record included
+	State PushArgs // View is not used
+}
+
+type wal struct {
+	dir   string
+	f     *os.File
+	w     *bufio.Writer
+	index int64 // number of the last record written
+	since int   // records written since the last snapshot
+}
+
+// open the data directory, returning the last snapshot and the
+// log records that follow it.
+func openWAL(dir string) (*wal, snapshot, []walRecord, error) {
+	var snap snapshot
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, snap, nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err == nil {
+		err = json.Unmarshal(b, &snap)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, snap, nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, snap, nil, err
+	}
+	records := []walRecord{}
+	dec := json.NewDecoder(f)
+	good := int64(0)
+	for {
+		var rec walRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// partially-written last record
+			if err := f.Truncate(good); err != nil {
+				f.Close()
+				return nil, snap, nil, err
+			}
+			break
+		}
+		good = dec.InputOffset()
+		if rec.Index > snap.Index {
+			records = append(records, rec)
+		}
+	}
+
+	l := &wal{dir: dir, f: f, w: bufio.NewWriter(f), index: snap.Index}
+	if len(records) > 0 {
+		l.index = records[len(records)-1].Index
+	}
+	l.since = len(records)
+	return l, snap, records, nil
+}
+
+// append an op to the log and force it to stable storage.
+func (l *wal) append(args OpArgs) error {
+	b, err := json.Marshal(walRecord{Index: l.index + 1, Args: args})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err := l.w.Write(b); err != nil {
+		return err
+	}
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.index++
+	l.since++
+	return nil
+}
+
+// replace the snapshot with state, and empty the log.
+func (l *wal) snapshot(state PushArgs) error {
+	b, err := json.Marshal(snapshot{Index: l.index, State: state})
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(l.dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(l.dir, snapshotFile)); err != nil {
+		return err
+	}
+	if d, err := os.Open(l.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	l.since = 0
+	return l.f.Truncate(0)
+}
+
+func (l *wal) close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,64 @@
+package pbservice
+
+import (
+	"strings"
+	"time"
+)
+
+//
+// Key watches. Every change to the database is recorded as an
+// Event, tagged with the revision it produced. Since the primary
+// and the backups apply the same ops in the same order, they
+// record the same events with the same revisions, and a Push
+// carries the recent events along. So a watcher that loses its
+// primary can ask the new one for everything after the last
+// revision it saw, and miss nothing.
+//
+// Only the most recent maxEvents events are kept. A watcher that
+// falls further behind than that gets ErrCompacted.
+//
+
+const maxEvents = 1024
+
+// default and longest time a Watch waits for changes.
+const (
+	defaultWatchTimeout = 5 * time.Second
+	maxWatchTimeout     = 10 * time.Second
+)
+
+// recent events, oldest first. every revision has exactly one
+// event, so their revisions are consecutive.
+type eventLog struct {
+	events []Event
+}
+
+func (el *eventLog) add(e Event) {
+	if len(el.events) >= maxEvents {
+		el.events = append(el.events[:0], el.events[1:]...)
+	}
+	el.events = append(el.events, e)
+}
+
+// the events after revision after that args is watching for.
+// ok is false if some of them have been discarded.
+func (el *eventLog) since(args WatchArgs, revision int64) (events []Event, ok bool) {
+	if args.AfterRevision >= revision {
+		return nil, true
+	}
+	if len(el.events) == 0 || el.events[0].Revision > args.AfterRevision+1 {
+		return nil, false
+	}
+	for _, e := range el.events {
+		if e.Revision > args.AfterRevision && args.matches(e.Key) {
+			events = append(events, e)
+		}
+	}
+	return events, true
+}
+
+func (args WatchArgs) matches(key string) bool {
+	if args.Prefix {
+		return strings.HasPrefix(key, args.Key)
+	}
+	return key == args.Key
+}
@@ -0,0 +1,179 @@
+package transport
+
+//
+// Pluggable transports for the RPC servers and clients.
+//
+// An address names its transport with a scheme:
+//
+//   unix:///var/tmp/vs   unix-domain socket (also just "/var/tmp/vs")
+//   tcp://host:port      plain TCP
+//   tls://host:port      TCP with mutual TLS
+//
+// unix and tcp are always available. tls needs certificates,
+// so a program that wants it must call Register("tls", NewTLS(...))
+// before it starts any servers or clients.
+//
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Transport listens on and dials addresses of one scheme.
+// The addr passed in has the scheme already stripped off.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+var (
+	mu         sync.Mutex
+	transports = map[string]Transport{
+		"unix": unixTransport{},
+		"tcp":  tcpTransport{},
+	}
+)
+
+// make t the transport for addresses starting with scheme://
+func Register(scheme string, t Transport) {
+	mu.Lock()
+	defer mu.Unlock()
+	transports[scheme] = t
+}
+
+// split an address into its scheme and the rest. addresses
+// without a scheme are unix socket paths.
+func Split(addr string) (string, string) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return addr[:i], addr[i+3:]
+	}
+	return "unix", addr
+}
+
+func lookup(addr string) (Transport, string, error) {
+	scheme, rest := Split(addr)
+	mu.Lock()
+	t, ok := transports[scheme]
+	mu.Unlock()
+	if !ok {
+		return nil, "", fmt.Errorf("transport: no transport for %q", scheme)
+	}
+	return t, rest, nil
+}
+
+// listen for connections on addr.
+func Listen(addr string) (net.Listener, error) {
+	t, rest, err := lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.Listen(rest)
+}
+
+// connect to addr.
+func Dial(addr string) (net.Conn, error) {
+	t, rest, err := lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.Dial(rest)
+}
+
+// shut down the sending side of conn, so that whatever the
+// server writes back is lost. used to simulate an unreliable
+// network on any transport.
+func CloseWrite(conn net.Conn) error {
+	if tc, ok := conn.(*tls.Conn); ok {
+		// a TLS connection can only be half-closed once the
+		// handshake is over.
+		tc.SetDeadline(time.Now().Add(time.Second))
+		err := tc.Handshake()
+		tc.SetDeadline(time.Time{})
+		if err != nil {
+			return err
+		}
+		return tc.CloseWrite()
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("transport: connection cannot be half-closed")
+}
+
+type unixTransport struct{}
+
+func (unixTransport) Listen(addr string) (net.Listener, error) {
+	os.Remove(addr) // in case an old server left its socket behind
+	return net.Listen("unix", addr)
+}
+
+func (unixTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("unix", addr)
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+type tlsTransport struct {
+	server *tls.Config
+	client *tls.Config
+}
+
+// a TLS transport over TCP. server is used for Listen, and should
+// require and verify client certificates; client is used for Dial.
+func NewTLS(server *tls.Config, client *tls.Config) Transport {
+	return &tlsTransport{server: server, client: client}
+}
+
+func (t *tlsTransport) Listen(addr string) (net.Listener, error) {
+	return tls.Listen("tcp", addr, t.server)
+}
+
+func (t *tlsTransport) Dial(addr string) (net.Conn, error) {
+	return tls.Dial("tcp", addr, t.client)
+}
+
+// build server and client configs for mutual TLS, where every
+// process presents the certificate in certFile/keyFile and
+// trusts peers whose certificates are signed by the CA in caFile.
+func MutualTLSConfig(certFile, keyFile, caFile string) (*tls.Config, *tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, nil, fmt.Errorf("transport: no certificates in %v", caFile)
+	}
+
+	server := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	client := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return server, client, nil
+}
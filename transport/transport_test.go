@@ -0,0 +1,248 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type Counter struct {
+	n int32
+}
+
+func (c *Counter) Add(args *int, reply *int) error {
+	*reply = int(atomic.AddInt32(&c.n, int32(*args)))
+	return nil
+}
+
+// serve a Counter on addr. if dropReplies, every reply is lost
+// the same way the pbservice tests lose them.
+func serve(t *testing.T, addr string, dropReplies bool) (*Counter, net.Listener) {
+	counter := &Counter{}
+	rpcs := rpc.NewServer()
+	rpcs.Register(counter)
+	l, err := Listen(addr)
+	if err != nil {
+		t.Fatalf("Listen(%v): %v", addr, err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if dropReplies {
+					if err := CloseWrite(conn); err != nil {
+						fmt.Printf("CloseWrite: %v\n", err)
+					}
+				}
+				rpcs.ServeConn(conn)
+			}()
+		}
+	}()
+	return counter, l
+}
+
+func add(addr string, n int) (int, error) {
+	conn, err := Dial(addr)
+	if err != nil {
+		return 0, err
+	}
+	c := rpc.NewClient(conn)
+	defer c.Close()
+	var reply int
+	err = c.Call("Counter.Add", &n, &reply)
+	return reply, err
+}
+
+func unixAddr(tag string) string {
+	s := "/var/tmp/824-"
+	s += strconv.Itoa(os.Getuid()) + "/"
+	os.Mkdir(s, 0777)
+	return "unix://" + s + "tr-" + strconv.Itoa(os.Getpid()) + "-" + tag
+}
+
+func tcpAddr(t *testing.T, scheme string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("no free port: %v", err)
+	}
+	defer l.Close()
+	return scheme + "://" + l.Addr().String()
+}
+
+// write a CA and a certificate it signs for 127.0.0.1 into dir.
+func makeCerts(t *testing.T, dir string) (string, string, string) {
+	write := func(name string, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+		if err := os.WriteFile(path, b, 0600); err != nil {
+			t.Fatalf("write %v: %v", path, err)
+		}
+		return path
+	}
+
+	cakey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	catmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	cader, err := x509.CreateCertificate(rand.Reader, catmpl, catmpl, &cakey.PublicKey, cakey)
+	if err != nil {
+		t.Fatalf("CA certificate: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(cader)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, cakey)
+	if err != nil {
+		t.Fatalf("certificate: %v", err)
+	}
+	keyder, _ := x509.MarshalECPrivateKey(key)
+
+	return write("node.pem", "CERTIFICATE", der),
+		write("node-key.pem", "EC PRIVATE KEY", keyder),
+		write("ca.pem", "CERTIFICATE", cader)
+}
+
+func registerTLS(t *testing.T) *tls.Config {
+	cert, key, ca := makeCerts(t, t.TempDir())
+	server, client, err := MutualTLSConfig(cert, key, ca)
+	if err != nil {
+		t.Fatalf("MutualTLSConfig: %v", err)
+	}
+	Register("tls", NewTLS(server, client))
+	return client
+}
+
+func TestSplit(t *testing.T) {
+	fmt.Printf("Test: Address schemes ...\n")
+
+	cases := []struct{ addr, scheme, rest string }{
+		{"/var/tmp/x", "unix", "/var/tmp/x"},
+		{"unix:///var/tmp/x", "unix", "/var/tmp/x"},
+		{"tcp://10.0.0.1:5000", "tcp", "10.0.0.1:5000"},
+		{"tls://host:5000", "tls", "host:5000"},
+	}
+	for _, c := range cases {
+		scheme, rest := Split(c.addr)
+		if scheme != c.scheme || rest != c.rest {
+			t.Fatalf("Split(%v) = %v, %v", c.addr, scheme, rest)
+		}
+	}
+	if _, err := Dial("carrier-pigeon://x"); err == nil {
+		t.Fatalf("Dial with unknown scheme succeeded")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTransports(t *testing.T) {
+	registerTLS(t)
+
+	addrs := map[string]string{
+		"unix": unixAddr("a"),
+		"tcp":  tcpAddr(t, "tcp"),
+		"tls":  tcpAddr(t, "tls"),
+	}
+	for _, scheme := range []string{"unix", "tcp", "tls"} {
+		fmt.Printf("Test: RPC over %v ...\n", scheme)
+
+		counter, l := serve(t, addrs[scheme], false)
+		for i := 1; i <= 3; i++ {
+			n, err := add(addrs[scheme], 1)
+			if err != nil || n != i {
+				t.Fatalf("%v: Add -> %v, %v; wanted %v", scheme, n, err, i)
+			}
+		}
+		if atomic.LoadInt32(&counter.n) != 3 {
+			t.Fatalf("%v: server saw %v calls", scheme, counter.n)
+		}
+		l.Close()
+
+		fmt.Printf("  ... Passed\n")
+	}
+}
+
+func TestDroppedReplies(t *testing.T) {
+	registerTLS(t)
+
+	addrs := map[string]string{
+		"unix": unixAddr("b"),
+		"tcp":  tcpAddr(t, "tcp"),
+		"tls":  tcpAddr(t, "tls"),
+	}
+	for _, scheme := range []string{"unix", "tcp", "tls"} {
+		fmt.Printf("Test: Reply lost, request executed over %v ...\n", scheme)
+
+		counter, l := serve(t, addrs[scheme], true)
+		if _, err := add(addrs[scheme], 1); err == nil {
+			t.Fatalf("%v: reply was not lost", scheme)
+		}
+		for iters := 0; iters < 50 && atomic.LoadInt32(&counter.n) == 0; iters++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if atomic.LoadInt32(&counter.n) != 1 {
+			t.Fatalf("%v: request was not executed", scheme)
+		}
+		l.Close()
+
+		fmt.Printf("  ... Passed\n")
+	}
+}
+
+func TestTLSNeedsClientCert(t *testing.T) {
+	client := registerTLS(t)
+
+	fmt.Printf("Test: TLS server rejects clients without a certificate ...\n")
+
+	addr := tcpAddr(t, "tls")
+	_, l := serve(t, addr, false)
+	defer l.Close()
+
+	_, rest := Split(addr)
+	anon := client.Clone()
+	anon.Certificates = nil
+	conn, err := tls.Dial("tcp", rest, anon)
+	if err == nil {
+		c := rpc.NewClient(conn)
+		var reply int
+		n := 1
+		err = c.Call("Counter.Add", &n, &reply)
+		c.Close()
+	}
+	if err == nil {
+		t.Fatalf("client without a certificate was served")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,163 @@
+package viewservice
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+//
+// Administrative view changes: forced failover, draining and
+// removing servers. Each is an input to the view state machine
+// like a Ping, so in replicated mode they go through the Paxos
+// log and every peer applies them at the same point.
+//
+
+// PromoteBackup() RPC handler implementation
+func (vs *ViewServer) PromoteBackupImpl(args *AdminArgs, reply *AdminReply) error {
+	return vs.adminImpl("Promote", args, reply)
+}
+
+// Drain() RPC handler implementation
+func (vs *ViewServer) DrainImpl(args *AdminArgs, reply *AdminReply) error {
+	return vs.adminImpl("Drain", args, reply)
+}
+
+// Remove() RPC handler implementation
+func (vs *ViewServer) RemoveImpl(args *AdminArgs, reply *AdminReply) error {
+	return vs.adminImpl("Remove", args, reply)
+}
+
+func (vs *ViewServer) adminImpl(kind string, args *AdminArgs, reply *AdminReply) error {
+	vs.impl.mu.Lock()
+	defer vs.impl.mu.Unlock()
+
+	now := vs.impl.clock.Now()
+	if vs.impl.px != nil {
+		entry := LogEntry{Kind: kind, Me: args.Server, Time: now.UnixNano()}
+		if !vs.agree(entry) {
+			return fmt.Errorf("ViewServer(%v): no agreement on %v", vs.me, kind)
+		}
+		reply.Err = vs.impl.lastResult
+	} else {
+		reply.Err = vs.admin(kind, args.Server, now)
+		vs.persist()
+		vs.announce()
+	}
+	reply.View = vs.impl.currentView
+	reply.Peers = vs.impl.peers
+	return nil
+}
+
+// apply an administrative operation to the view state.
+func (vs *ViewServer) admin(kind string, server string, now time.Time) Err {
+	switch kind {
+	case "Promote":
+		return vs.promote(now)
+	case "Drain":
+		if err := vs.evict(server, ReasonDrained, now); err != OK {
+			return err
+		}
+		vs.impl.drained[server] = true
+		return OK
+	case "Remove":
+		if err := vs.evict(server, ReasonRemoved, now); err != OK {
+			return err
+		}
+		vs.impl.remover <- server
+		return OK
+	}
+	return Err("unknown admin operation " + kind)
+}
+
+// hand the primary role to the first backup. the old primary
+// goes to the end of the backup list.
+func (vs *ViewServer) promote(now time.Time) Err {
+	if !vs.impl.primaryAcked {
+		return ErrNotAcked
+	}
+	view := vs.impl.currentView
+	if len(view.Backups) == 0 {
+		return ErrNoBackup
+	}
+	if vs.revokeLease(now) {
+		return ErrLeaseHeld
+	}
+	vs.impl.currentView.Primary = view.Backups[0]
+	vs.setBackups(append(append([]string{}, view.Backups[1:]...), view.Primary))
+	vs.IncrementView()
+	vs.record(ReasonPromoted, vs.impl.currentView.Primary, now)
+	return OK
+}
+
+// move server out of the view, if it is in it. a primary is
+// replaced by its first backup, and idle servers fill in.
+func (vs *ViewServer) evict(server string, reason string, now time.Time) Err {
+	view := vs.impl.currentView
+	if view.Primary != server && !view.IsBackup(server) {
+		return OK
+	}
+	if !vs.impl.primaryAcked {
+		return ErrNotAcked
+	}
+	if view.Primary == server {
+		if len(view.Backups) == 0 {
+			return ErrNoBackup
+		}
+		if vs.revokeLease(now) {
+			return ErrLeaseHeld
+		}
+		vs.impl.currentView.Primary = view.Backups[0]
+		vs.setBackups(view.Backups[1:])
+	} else {
+		backups := []string{}
+		for _, backup := range view.Backups {
+			if backup != server {
+				backups = append(backups, backup)
+			}
+		}
+		vs.setBackups(backups)
+	}
+	// the evicted server would otherwise be picked right back.
+	wasDrained := vs.impl.drained[server]
+	vs.impl.drained[server] = true
+	vs.refillBackups()
+	if !wasDrained {
+		delete(vs.impl.drained, server)
+	}
+	vs.IncrementView()
+	vs.record(reason, server, now)
+	return OK
+}
+
+// before replacing the primary: if its lease may not have run
+// out yet, stop renewing it so that it does, and return true.
+func (vs *ViewServer) revokeLease(now time.Time) bool {
+	if !vs.leaseHeld(now) {
+		return false
+	}
+	vs.impl.leaseRevoked = vs.impl.currentView.Primary
+	return true
+}
+
+// the drained servers, in order.
+func (vs *ViewServer) drainedList() []string {
+	list := []string{}
+	for server := range vs.impl.drained {
+		list = append(list, server)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -3,24 +3,81 @@ package viewservice
 import (
 	"fmt"
 	"net/rpc"
+	"sync"
+	"time"
+
+	"umich.edu/eecs491/proj2/transport"
 )
 
 //
 // the viewservice Clerk lives in the client
 // and maintains a little state.
 //
+// If the viewservice is replicated, the Clerk learns the
+// list of peers from their replies, sticks with the peer
+// that last answered, and moves on to the next peer when
+// that one stops answering.
+//
+// It also remembers the ping timing the viewservice last
+// advertised, see Timing().
+//
 type Clerk struct {
-	me     string // client's name (host:port)
-	server string // viewservice's host:port
+	mu           sync.Mutex
+	me           string   // client's name (host:port)
+	servers      []string // viewservice peers' host:port
+	leader       int      // index of the peer that last answered
+	pingInterval time.Duration
+	deadPings    int
 }
 
 func MakeClerk(me string, server string) *Clerk {
+	return MakeReplicatedClerk(me, []string{server})
+}
+
+func MakeReplicatedClerk(me string, servers []string) *Clerk {
 	ck := new(Clerk)
 	ck.me = me
-	ck.server = server
+	ck.servers = append([]string{}, servers...)
 	return ck
 }
 
+// send an RPC to the viewservice, trying each peer in turn
+// until one answers. peers is filled in from the reply.
+func (ck *Clerk) callAny(rpcname string, args interface{},
+	reply interface{}, peers *[]string) bool {
+	ck.mu.Lock()
+	servers := ck.servers
+	leader := ck.leader
+	ck.mu.Unlock()
+
+	for i := 0; i < len(servers); i++ {
+		n := (leader + i) % len(servers)
+		if call(servers[n], rpcname, args, reply) {
+			ck.mu.Lock()
+			ck.leader = n
+			if len(*peers) > 0 {
+				ck.learn(*peers)
+			}
+			ck.mu.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// adopt the peer list reported by the viewservice, keeping
+// the peer we are talking to as leader. ck.mu must be held.
+func (ck *Clerk) learn(peers []string) {
+	current := ck.servers[ck.leader]
+	ck.servers = append([]string{}, peers...)
+	ck.leader = 0
+	for i, peer := range ck.servers {
+		if peer == current {
+			ck.leader = i
+		}
+	}
+}
+
 //
 // call() sends an RPC to the rpcname handler on server srv
 // with arguments args, waits for the reply, and leaves the
@@ -37,10 +94,11 @@ func MakeClerk(me string, server string) *Clerk {
 //
 func call(srv string, rpcname string,
 	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
+	conn, errx := transport.Dial(srv)
 	if errx != nil {
 		return false
 	}
+	c := rpc.NewClient(conn)
 	defer c.Close()
 
 	err := c.Call(rpcname, args, reply)
@@ -53,6 +111,13 @@ func call(srv string, rpcname string,
 }
 
 func (ck *Clerk) Ping(viewnum uint) (View, error) {
+	view, _, err := ck.PingLease(viewnum)
+	return view, err
+}
+
+// Ping, also returning the lease granted if we are the primary
+// and viewnum is the current view (0 if none). see PingReply.
+func (ck *Clerk) PingLease(viewnum uint) (View, time.Duration, error) {
 	// prepare the arguments.
 	args := &PingArgs{}
 	args.Me = ck.me
@@ -60,24 +125,44 @@ func (ck *Clerk) Ping(viewnum uint) (View, error) {
 	var reply PingReply
 
 	// send an RPC request, wait for the reply.
-	ok := call(ck.server, "ViewServer.Ping", args, &reply)
+	ok := ck.callAny("ViewServer.Ping", args, &reply, &reply.Peers)
 	if ok == false {
-		return View{}, fmt.Errorf("Ping(%v) failed", viewnum)
+		return View{}, 0, fmt.Errorf("Ping(%v) failed", viewnum)
 	}
+	ck.noteTiming(reply.PingInterval, reply.DeadPings)
 
-	return reply.View, nil
+	return reply.View, reply.Lease, nil
 }
 
 func (ck *Clerk) Get() (View, bool) {
 	args := &GetArgs{}
 	var reply GetReply
-	ok := call(ck.server, "ViewServer.Get", args, &reply)
+	ok := ck.callAny("ViewServer.Get", args, &reply, &reply.Peers)
 	if ok == false {
 		return View{}, false
 	}
+	ck.noteTiming(reply.PingInterval, reply.DeadPings)
 	return reply.View, true
 }
 
+func (ck *Clerk) noteTiming(pingInterval time.Duration, deadPings int) {
+	if pingInterval <= 0 || deadPings <= 0 {
+		return
+	}
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.pingInterval = pingInterval
+	ck.deadPings = deadPings
+}
+
+// the ping interval and dead-ping count advertised by the
+// viewservice. ok is false until the Clerk has heard from it.
+func (ck *Clerk) Timing() (pingInterval time.Duration, deadPings int, ok bool) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	return ck.pingInterval, ck.deadPings, ck.pingInterval > 0
+}
+
 func (ck *Clerk) Primary() string {
 	v, ok := ck.Get()
 	if ok {
@@ -85,3 +170,109 @@ func (ck *Clerk) Primary() string {
 	}
 	return ""
 }
+
+// wait for a view newer than afterViewnum, for at most timeout.
+// returns the current view, which is not newer if the wait
+// timed out; ok is false if no viewservice peer answered.
+func (ck *Clerk) Watch(afterViewnum uint, timeout time.Duration) (View, bool) {
+	args := &WatchArgs{AfterViewnum: afterViewnum, Timeout: timeout}
+	var reply WatchReply
+	ok := ck.callAny("ViewServer.Watch", args, &reply, &reply.Peers)
+	if ok == false {
+		return View{}, false
+	}
+	ck.noteTiming(reply.PingInterval, reply.DeadPings)
+	return reply.View, true
+}
+
+// deliver every new view on the returned channel, starting
+// with the current one, until stop is called. views that
+// change faster than the receiver reads may be skipped.
+func (ck *Clerk) Subscribe() (<-chan View, func()) {
+	views := make(chan View)
+	done := make(chan struct{})
+	go func() {
+		defer close(views)
+		var viewnum uint
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			v, ok := ck.Watch(viewnum, 0)
+			if !ok {
+				interval, _, known := ck.Timing()
+				if !known {
+					interval = PingInterval
+				}
+				select {
+				case <-done:
+					return
+				case <-time.After(interval):
+				}
+				continue
+			}
+			if v.Viewnum <= viewnum {
+				continue
+			}
+			select {
+			case views <- v:
+				viewnum = v.Viewnum
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	stop := func() { once.Do(func() { close(done) }) }
+	return views, stop
+}
+
+// the ViewServer's recent view changes, oldest first.
+func (ck *Clerk) History() ([]ViewChange, bool) {
+	args := &HistoryArgs{}
+	var reply HistoryReply
+	ok := ck.callAny("ViewServer.History", args, &reply, &reply.Peers)
+	if ok == false {
+		return nil, false
+	}
+	return reply.Changes, true
+}
+
+// send an admin RPC, waiting out the primary's lease if the
+// operation would replace the primary.
+func (ck *Clerk) admin(rpcname string, server string) (View, Err) {
+	for {
+		args := &AdminArgs{Server: server}
+		var reply AdminReply
+		ok := ck.callAny(rpcname, args, &reply, &reply.Peers)
+		if ok == false {
+			return View{}, ErrUnreachable
+		}
+		if reply.Err != ErrLeaseHeld {
+			return reply.View, reply.Err
+		}
+		interval, _, known := ck.Timing()
+		if !known {
+			interval = PingInterval
+		}
+		time.Sleep(interval)
+	}
+}
+
+// make the first backup the primary, once the primary has
+// acked the current view. returns the resulting view.
+func (ck *Clerk) PromoteBackup() (View, Err) {
+	return ck.admin("ViewServer.PromoteBackup", "")
+}
+
+// never use server as primary or backup again.
+func (ck *Clerk) Drain(server string) (View, Err) {
+	return ck.admin("ViewServer.Drain", server)
+}
+
+// move server out of the view and forget about it.
+func (ck *Clerk) Remove(server string) (View, Err) {
+	return ck.admin("ViewServer.Remove", server)
+}
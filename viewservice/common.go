@@ -3,19 +3,23 @@ package viewservice
 import "time"
 
 //
-// This is a non-replicated view service for a simple
-// primary/backup system.
+// This is a view service for a simple primary/backup
+// system. It runs either as a single server or as a group
+// of peers that replicate it with Paxos (see replicated.go).
 //
 // The view service goes through a sequence of numbered
-// views, each with a primary and (if possible) a backup.
+// views, each with a primary and (if possible) some backups.
 // A view consists of a view number and the host:port of
-// the view's primary and backup p/b servers.
+// the view's primary and backup p/b servers. How many
+// backups a view should have is set by Config.Backups.
 //
 // The primary in a view is always either the primary
-// or the backup of the previous view (in order to ensure
-// that the p/b service's state is preserved).
+// or a backup of the previous view (in order to ensure
+// that the p/b service's state is preserved). When the
+// primary fails, the first backup takes over.
 //
-// Each p/b server should send a Ping RPC once per PingInterval.
+// Each p/b server should send a Ping RPC once per PingInterval,
+// as advertised in the ViewServer's replies.
 // The view server replies with a description of the current
 // view. The Pings let the view server know that the p/b
 // server is still alive; inform the p/b server of the current
@@ -36,15 +40,43 @@ import "time"
 type View struct {
 	Viewnum uint
 	Primary string
-	Backup  string
+	Backup  string   // the first of Backups, or ""
+	Backups []string // in promotion order
+}
+
+// is server one of the view's backups?
+func (v View) IsBackup(server string) bool {
+	for _, backup := range v.Backups {
+		if backup == server {
+			return true
+		}
+	}
+	return false
+}
+
+// do two views describe the same servers in the same roles?
+func (v View) Equal(o View) bool {
+	if v.Viewnum != o.Viewnum || v.Primary != o.Primary ||
+		len(v.Backups) != len(o.Backups) {
+		return false
+	}
+	for i := range v.Backups {
+		if v.Backups[i] != o.Backups[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // clients should send a Ping RPC this often,
 // to tell the viewservice that the client is alive.
+// this is the default; a ViewServer can be started with
+// its own Config.PingInterval, and tells pingers about it.
 const PingInterval = time.Millisecond * 100
 
 // the viewserver will declare a client dead if it misses
-// this many Ping RPCs in a row.
+// this many Ping RPCs in a row. also overridable with
+// Config.DeadPings.
 const DeadPings = 5
 
 //
@@ -63,18 +95,123 @@ type PingArgs struct {
 }
 
 type PingReply struct {
-	View View
+	View         View
+	Peers        []string      // all viewservice peers, if replicated
+	PingInterval time.Duration // how often the caller should Ping
+	DeadPings    int           // missed Pings before the caller is dead
+	Lease        time.Duration // primary only: see below
 }
 
+// A primary that has acked View gets a lease in the reply: it
+// may act alone for Lease from when it sent the Ping, and the
+// viewservice will not choose another primary until then, unless
+// the primary restarts (which ends the lease). Lease is 0 if no
+// lease was granted.
+
 //
 // Get(): fetch the current view, without volunteering
 // to be a server. mostly for clients of the p/b service,
-// and for testing.
+// and for testing. a replicated peer that can't reach a
+// majority of its peers fails the call, so that the Clerk
+// moves on to another.
 //
 
 type GetArgs struct {
 }
 
 type GetReply struct {
-	View View
+	View         View
+	Peers        []string // all viewservice peers, if replicated
+	PingInterval time.Duration
+	DeadPings    int
+}
+
+//
+// Watch(): like Get(), but wait until there is a view newer
+// than AfterViewnum, or until Timeout has passed, before
+// replying. lets clients react to view changes right away
+// without polling.
+//
+
+type WatchArgs struct {
+	AfterViewnum uint
+	Timeout      time.Duration // zero means the server's default
+}
+
+type WatchReply struct {
+	View         View
+	Peers        []string // all viewservice peers, if replicated
+	PingInterval time.Duration
+	DeadPings    int
+}
+
+//
+// History(): fetch the most recent view changes, oldest
+// first, each with the reason the ViewServer moved to it.
+//
+
+// why the view changed.
+const (
+	ReasonInitialPrimary = "initial primary"
+	ReasonBackupAdded    = "backup added"
+	ReasonPrimaryTimeout = "primary timeout"
+	ReasonPrimaryRestart = "primary restart"
+	ReasonBackupTimeout  = "backup timeout"
+	ReasonPromoted       = "backup promoted"
+	ReasonDrained        = "server drained"
+	ReasonRemoved        = "server removed"
+)
+
+type ViewChange struct {
+	View   View      // the view moved to
+	Reason string    // one of the Reason constants
+	Server string    // the server that caused the change
+	Time   time.Time // when the ViewServer made the change
+}
+
+type HistoryArgs struct {
+}
+
+type HistoryReply struct {
+	Changes []ViewChange
+	Peers   []string // all viewservice peers, if replicated
+}
+
+//
+// Administrative RPCs, for operators:
+//
+// PromoteBackup(): make the first backup the primary. the old
+// primary becomes the last backup.
+//
+// Drain(Server): never choose Server as primary or backup
+// again, moving it out of the view if it is in it.
+//
+// Remove(Server): move Server out of the view if it is in it,
+// and forget it. a removed server that pings again is treated
+// as new, so drain it first to keep it out for good.
+//
+// Like any view change, these wait for the primary to ack the
+// current view; until it has, they fail with ErrNotAcked. One
+// that replaces the primary also stops its lease from being
+// renewed, and fails with ErrLeaseHeld until it has run out.
+//
+
+type Err string
+
+const (
+	OK             = "OK"
+	ErrNotAcked    = "ErrNotAcked"    // primary hasn't acked the current view
+	ErrNoBackup    = "ErrNoBackup"    // no backup to take over as primary
+	ErrLeaseHeld   = "ErrLeaseHeld"   // primary's lease hasn't run out; try again
+	ErrUnreachable = "ErrUnreachable" // Clerk only: no viewservice answered
+)
+
+type AdminArgs struct {
+	Server string // not used by PromoteBackup
+}
+
+type AdminReply struct {
+	Err   Err
+	View  View     // the view after the operation
+	Peers []string // all viewservice peers, if replicated
 }
@@ -0,0 +1,121 @@
+package viewservice
+
+import (
+	"math"
+	"time"
+)
+
+//
+// Failure detection. By default the ViewServer counts ticks
+// since each server's last Ping, and declares it dead after
+// DeadPings of them. Config.Detector = "phi" switches to a
+// phi-accrual detector instead: the ViewServer keeps a window
+// of each server's recent Ping inter-arrival times, and turns
+// the time since its last Ping into a suspicion level phi,
+//
+//   phi = -log10(P(the next Ping is still coming after this long))
+//
+// assuming inter-arrival times are normally distributed. A
+// server is dead once phi reaches Config.PhiThreshold. Servers
+// whose pings are irregular get a wider distribution, and so
+// more slack, than servers that ping like clockwork.
+//
+
+const (
+	CounterDetector = "counter"
+	PhiDetector     = "phi"
+)
+
+// default suspicion level at which the phi detector gives up
+// on a server; roughly a one-in-10^8 chance of being wrong.
+const DefaultPhiThreshold = 8.0
+
+// how many inter-arrival samples the phi detector remembers.
+const phiWindowSize = 100
+
+// Where the ViewServer gets the time. Tests substitute a
+// fake clock to drive the phi detector.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// recent Ping inter-arrival times for one server.
+type arrivalWindow struct {
+	last      time.Time
+	intervals []time.Duration // ring of the most recent samples
+	next      int
+}
+
+// forget all history, e.g. when a dead server comes back.
+func (w *arrivalWindow) reset() {
+	w.last = time.Time{}
+	w.intervals = nil
+	w.next = 0
+}
+
+// record a Ping that arrived at now.
+func (w *arrivalWindow) heartbeat(now time.Time) {
+	if !w.last.IsZero() && now.After(w.last) {
+		sample := now.Sub(w.last)
+		if len(w.intervals) < phiWindowSize {
+			w.intervals = append(w.intervals, sample)
+		} else {
+			w.intervals[w.next] = sample
+			w.next = (w.next + 1) % phiWindowSize
+		}
+	}
+	if now.After(w.last) {
+		w.last = now
+	}
+}
+
+// mean and standard deviation of the window. until there is
+// enough history, assume Pings every expected interval.
+func (w *arrivalWindow) stats(expected time.Duration) (float64, float64) {
+	if len(w.intervals) < 2 {
+		mean := float64(expected)
+		return mean, mean / 4
+	}
+	sum := 0.0
+	for _, d := range w.intervals {
+		sum += float64(d)
+	}
+	mean := sum / float64(len(w.intervals))
+	variance := 0.0
+	for _, d := range w.intervals {
+		variance += (float64(d) - mean) * (float64(d) - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(w.intervals)))
+
+	// a perfectly regular server would otherwise be
+	// suspected the moment it is a little late.
+	if min := float64(expected) / 10; stddev < min {
+		stddev = min
+	}
+	return mean, stddev
+}
+
+// the suspicion level for a server whose last Ping was at
+// w.last, as of now.
+func (w *arrivalWindow) phi(now time.Time, expected time.Duration) float64 {
+	if w.last.IsZero() {
+		return 0
+	}
+	elapsed := float64(now.Sub(w.last))
+	mean, stddev := w.stats(expected)
+
+	// logistic approximation of the normal CDF, as used by
+	// Cassandra and Akka.
+	y := (elapsed - mean) / stddev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1.0 + e))
+	}
+	return -math.Log10(1.0 - 1.0/(1.0+e))
+}
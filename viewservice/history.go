@@ -0,0 +1,41 @@
+package viewservice
+
+//
+// The ViewServer remembers its most recent view changes, and
+// why each happened, so that failovers can be reconstructed
+// after the fact. Only the last Config.HistorySize changes are
+// kept. In replicated mode every peer records the same changes,
+// stamped with the time carried in the log entry that caused
+// them; with a LogFile, the changes are logged alongside the
+// views and survive a restart.
+//
+
+// default number of view changes History() reports.
+const DefaultHistorySize = 100
+
+// a ring of the most recent view changes.
+type viewHistory struct {
+	changes []ViewChange
+	next    int
+	size    int
+}
+
+func (h *viewHistory) add(c ViewChange) {
+	if h.size <= 0 {
+		return
+	}
+	if len(h.changes) < h.size {
+		h.changes = append(h.changes, c)
+	} else {
+		h.changes[h.next] = c
+		h.next = (h.next + 1) % h.size
+	}
+}
+
+// the remembered changes, oldest first.
+func (h *viewHistory) list() []ViewChange {
+	list := make([]ViewChange, 0, len(h.changes))
+	list = append(list, h.changes[h.next:]...)
+	list = append(list, h.changes[:h.next]...)
+	return list
+}
@@ -0,0 +1,266 @@
+package viewservice
+
+import (
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/rpc"
+	"os"
+	"time"
+
+	"umich.edu/eecs491/proj2/paxos"
+)
+
+//
+// Replicated mode. When Config.Peers is set, the ViewServer is
+// one of several peers that keep identical copies of the view
+// state. Every Ping and every tick is an input to that state,
+// and the peers use Paxos to agree on one ordered log of inputs.
+// Each peer applies the log in order with the same code used by
+// a lone ViewServer, so all of them go through the same views.
+//
+// Every peer proposes a Tick once per ping interval. A Tick carries
+// the interval (epoch) it was proposed in, and only the first Tick
+// decided for a given epoch is applied, so the number of peers
+// does not change how quickly servers are declared dead.
+//
+// Get and Watch go through the log too, as a no-op entry, so a
+// peer cut off from the majority fails them rather than handing
+// out a view that may have moved on.
+//
+// Each peer needs its own Config.LogFile. Its Paxos acceptor
+// state is kept in LogFile.paxos, and every snapshotEvery
+// entries it writes its view state, as of the next instance to
+// apply, to LogFile; only then does it tell Paxos that it is
+// done with the instances before. A peer that crashes and is
+// started again on the same files resumes from the snapshot and
+// applies the rest of the log, so it goes through the same
+// views as the others, and view numbers carry on even if every
+// peer restarts. The service keeps going as long as a majority
+// of peers is alive.
+//
+
+// log entries to apply between snapshots.
+const snapshotEvery = 100
+
+// One input to the view state machine.
+type LogEntry struct {
+	ID      int64  // random, so a proposer can recognize its own entry
+	Kind    string // "Ping", "Tick", "Get", or an admin operation
+	Me      string // Ping: the pinging server; admin: the target
+	Viewnum uint   // Ping: the server's view number
+	Epoch   int64  // Tick: the ping interval it was proposed in
+	Time    int64  // proposer's clock, in UnixNano
+}
+
+func init() {
+	gob.Register(LogEntry{})
+}
+
+func nrand() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := rand.Int(rand.Reader, max)
+	return bigx.Int64()
+}
+
+// a peer's view state as of instance Seq, as kept in its LogFile.
+type peerSnapshot struct {
+	Seq          int
+	View         View
+	PrimaryAcked bool
+	Drained      []string
+	Changes      []ViewChange
+	LastEpoch    int64
+	LeaseUntil   time.Time
+	LeaseRevoked string
+	Servers      []serverSnapshot
+}
+
+type serverSnapshot struct {
+	ID        string
+	Missed    int
+	Alive     bool
+	Last      time.Time
+	Intervals []time.Duration
+	Next      int
+}
+
+// set up the Paxos peer for replicated mode, resuming from the
+// state in logFile; its handlers share the ViewServer's listener.
+func (vs *ViewServer) initPaxos(peers []string, logFile string, rpcs *rpc.Server) {
+	me := -1
+	for i, peer := range peers {
+		if peer == vs.me {
+			me = i
+		}
+	}
+	if me < 0 {
+		log.Fatalf("ViewServer(%v) is not in its peer list %v", vs.me, peers)
+	}
+	vs.impl.peers = peers
+	vs.impl.snapshotFile = logFile
+	px, err := paxos.MakePersistent(peers, me, rpcs, vs.dead, logFile+".paxos")
+	if err != nil {
+		log.Fatal("viewservice paxos: ", err)
+	}
+	vs.impl.px = px
+
+	b, err := os.ReadFile(logFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	var snap peerSnapshot
+	if err == nil {
+		err = json.Unmarshal(b, &snap)
+	}
+	if err != nil {
+		log.Fatal("viewservice snapshot: ", err)
+	}
+	vs.restore(snap)
+	log.Printf("ViewServer(%v) resumed view %v at instance %v\n", vs.me, snap.View, snap.Seq)
+}
+
+// the view state, as of the next instance to apply.
+// vs.impl.mu must be held.
+func (vs *ViewServer) snapshot() peerSnapshot {
+	snap := peerSnapshot{Seq: vs.impl.nextSeq, View: vs.impl.currentView,
+		PrimaryAcked: vs.impl.primaryAcked, Drained: vs.drainedList(),
+		Changes: vs.impl.history.list(), LastEpoch: vs.impl.lastEpoch,
+		LeaseUntil: vs.impl.leaseUntil, LeaseRevoked: vs.impl.leaseRevoked}
+	for _, proxy := range vs.sortedProxies() {
+		snap.Servers = append(snap.Servers, serverSnapshot{ID: proxy.ID,
+			Missed: proxy.missedHeartbeats, Alive: proxy.alive,
+			Last: proxy.arrivals.last, Intervals: proxy.arrivals.intervals,
+			Next: proxy.arrivals.next})
+	}
+	return snap
+}
+
+func (vs *ViewServer) restore(snap peerSnapshot) {
+	vs.impl.nextSeq = snap.Seq
+	vs.impl.snapshotSeq = snap.Seq
+	vs.impl.currentView = snap.View
+	vs.impl.announced = snap.View.Viewnum
+	vs.impl.primaryAcked = snap.PrimaryAcked
+	for _, server := range snap.Drained {
+		vs.impl.drained[server] = true
+	}
+	for _, c := range snap.Changes {
+		vs.impl.history.add(c)
+	}
+	vs.impl.lastEpoch = snap.LastEpoch
+	vs.impl.leaseUntil = snap.LeaseUntil
+	vs.impl.leaseRevoked = snap.LeaseRevoked
+	for _, s := range snap.Servers {
+		vs.add(s.ID)
+		proxy := vs.get()[s.ID]
+		proxy.missedHeartbeats = s.Missed
+		proxy.alive = s.Alive
+		proxy.arrivals = arrivalWindow{last: s.Last, intervals: s.Intervals, next: s.Next}
+	}
+}
+
+// write a snapshot, and let Paxos forget the instances it
+// covers. vs.impl.mu must be held.
+func (vs *ViewServer) saveSnapshot() {
+	b, err := json.Marshal(vs.snapshot())
+	if err != nil {
+		log.Fatal("viewservice snapshot: ", err)
+	}
+	tmp := vs.impl.snapshotFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err == nil {
+		_, err = f.Write(b)
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, vs.impl.snapshotFile)
+	}
+	if err != nil {
+		log.Fatal("viewservice snapshot: ", err)
+	}
+	vs.impl.snapshotSeq = vs.impl.nextSeq
+	vs.impl.px.Done(vs.impl.nextSeq - 1)
+}
+
+// the tick epoch that now falls in.
+func (vs *ViewServer) epoch(now time.Time) int64 {
+	return now.UnixNano() / int64(vs.impl.pingInterval)
+}
+
+// apply one decided log entry. vs.impl.mu must be held.
+func (vs *ViewServer) apply(entry LogEntry) {
+	switch entry.Kind {
+	case "Ping":
+		vs.ping(entry.Me, entry.Viewnum, time.Unix(0, entry.Time))
+	case "Tick":
+		if entry.Epoch > vs.impl.lastEpoch {
+			vs.impl.lastEpoch = entry.Epoch
+			vs.detectFailures(time.Unix(0, entry.Time))
+		}
+	case "Promote", "Drain", "Remove":
+		vs.impl.lastResult = vs.admin(entry.Kind, entry.Me, time.Unix(0, entry.Time))
+	}
+	vs.announce()
+	vs.impl.nextSeq++
+	if vs.impl.nextSeq-vs.impl.snapshotSeq >= snapshotEvery {
+		vs.saveSnapshot()
+	}
+}
+
+// apply every entry that is already known to be decided.
+// vs.impl.mu must be held.
+func (vs *ViewServer) catchUp() {
+	for {
+		fate, v := vs.impl.px.Status(vs.impl.nextSeq)
+		if fate != paxos.Decided {
+			return
+		}
+		vs.apply(v.(LogEntry))
+	}
+}
+
+// wait for instance seq to be decided.
+func (vs *ViewServer) waitDecided(seq int, deadline time.Time) (LogEntry, bool) {
+	to := 5 * time.Millisecond
+	for !vs.isdead() && time.Now().Before(deadline) {
+		fate, v := vs.impl.px.Status(seq)
+		if fate == paxos.Decided {
+			return v.(LogEntry), true
+		}
+		time.Sleep(to)
+		if to < vs.impl.pingInterval/2 {
+			to *= 2
+		}
+	}
+	return LogEntry{}, false
+}
+
+// get entry into the log, applying everything before it and
+// then the entry itself. returns false if no agreement was
+// reached in time. vs.impl.mu must be held.
+func (vs *ViewServer) agree(entry LogEntry) bool {
+	entry.ID = nrand()
+	// give up in time for the pinger to try another peer
+	// before it is declared dead.
+	deadline := time.Now().Add(vs.impl.pingInterval * time.Duration(vs.impl.deadPings))
+
+	vs.catchUp()
+	for {
+		seq := vs.impl.nextSeq
+		vs.impl.px.Start(seq, entry)
+		decided, ok := vs.waitDecided(seq, deadline)
+		if !ok {
+			return false
+		}
+		vs.apply(decided)
+		if decided.ID == entry.ID {
+			return true
+		}
+	}
+}
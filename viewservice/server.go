@@ -6,9 +6,10 @@ import (
 	"log"
 	"net"
 	"net/rpc"
-	"os"
 	"sync/atomic"
 	"time"
+
+	"umich.edu/eecs491/proj2/transport"
 )
 
 type ViewServer struct {
@@ -26,6 +27,7 @@ func (vs *ViewServer) Kill(vsterm chan interface{}) {
 	fmt.Printf("Killing viewserver %v\n", vs.me)
 	close(vsterm)
 	vs.l.Close()
+	vs.closeLog()
 }
 
 // has this server been asked to shut down?
@@ -42,20 +44,80 @@ func (vs *ViewServer) GetRPCCount() int32 {
 	return atomic.LoadInt32(&vs.rpccount)
 }
 
+// Optional ViewServer settings; the zero value gives the
+// original in-memory behavior.
+type Config struct {
+	// If set, every view transition is appended to this file
+	// and replayed when a ViewServer is started on it again.
+	// A replicated peer keeps its own state here instead (see
+	// replicated.go).
+	LogFile string
+
+	// If set, run as one of a group of replicated peers. me
+	// must be one of Peers, and every peer must be started
+	// with the same list and its own LogFile.
+	Peers []string
+
+	// The number of backups each view should have, once
+	// enough servers are pinging. Defaults to 1.
+	Backups int
+
+	// Failure-detection timing, advertised to pingers in
+	// every reply. Default to the PingInterval and DeadPings
+	// constants. All peers of a replicated viewservice must
+	// use the same values.
+	PingInterval time.Duration
+	DeadPings    int
+
+	// How to decide that a server has died: CounterDetector
+	// (the default) waits for DeadPings missed Pings, while
+	// PhiDetector waits for its suspicion level to reach
+	// PhiThreshold (default DefaultPhiThreshold).
+	Detector     string
+	PhiThreshold float64
+
+	// Source of time for failure detection; defaults to the
+	// system clock.
+	Clock Clock
+
+	// How many past view changes History() reports. Defaults
+	// to DefaultHistorySize.
+	HistorySize int
+
+	// How long the primary may go on acting alone (serving
+	// reads without its backups) after each Ping that acks
+	// the current view. No other primary is chosen until the
+	// last such lease has run out. Defaults to DeadPings-1
+	// ping intervals; < 0 means no leases.
+	Lease time.Duration
+}
+
 func StartServer(me string, term <-chan interface{}) *ViewServer {
+	return StartServerWithConfig(me, Config{}, term)
+}
+
+func StartServerWithConfig(me string, cfg Config, term <-chan interface{}) *ViewServer {
+	if len(cfg.Peers) > 0 && cfg.LogFile == "" {
+		// a peer that forgot its Paxos promises could not
+		// safely rejoin.
+		log.Fatal("viewservice: Peers needs a LogFile")
+	}
+
 	vs := new(ViewServer)
 	vs.dead = term
 	vs.me = me
-	vs.initImpl()
+	vs.initImpl(cfg)
 
 	// tell net/rpc about our RPC server and handlers.
 	rpcs := rpc.NewServer()
 	rpcs.Register(vs)
+	if len(cfg.Peers) > 0 {
+		vs.initPaxos(cfg.Peers, cfg.LogFile, rpcs)
+	}
 
 	// prepare to receive connections from clients.
-	// change "unix" to "tcp" to use over a network.
-	os.Remove(vs.me) // only needed for "unix"
-	l, e := net.Listen("unix", vs.me)
+	// the scheme of vs.me picks the transport.
+	l, e := transport.Listen(vs.me)
 	if e != nil {
 		log.Fatal("listen error: ", e)
 	}
@@ -89,7 +151,7 @@ func StartServer(me string, term <-chan interface{}) *ViewServer {
 	go func() {
 		for vs.isdead() == false {
 			vs.tick()
-			time.Sleep(PingInterval)
+			time.Sleep(vs.impl.pingInterval)
 		}
 	}()
 
@@ -115,3 +177,53 @@ func (vs *ViewServer) Get(args *GetArgs, reply *GetReply) error {
 		return vs.GetImpl(args, reply)
 	}
 }
+
+// Watch Wrapper
+func (vs *ViewServer) Watch(args *WatchArgs, reply *WatchReply) error {
+	if vs.isdead() {
+		errString := "Server " + vs.me + " is dead"
+		return errors.New(errString)
+	} else {
+		return vs.WatchImpl(args, reply)
+	}
+}
+
+// History Wrapper
+func (vs *ViewServer) History(args *HistoryArgs, reply *HistoryReply) error {
+	if vs.isdead() {
+		errString := "Server " + vs.me + " is dead"
+		return errors.New(errString)
+	} else {
+		return vs.HistoryImpl(args, reply)
+	}
+}
+
+// PromoteBackup Wrapper
+func (vs *ViewServer) PromoteBackup(args *AdminArgs, reply *AdminReply) error {
+	if vs.isdead() {
+		errString := "Server " + vs.me + " is dead"
+		return errors.New(errString)
+	} else {
+		return vs.PromoteBackupImpl(args, reply)
+	}
+}
+
+// Drain Wrapper
+func (vs *ViewServer) Drain(args *AdminArgs, reply *AdminReply) error {
+	if vs.isdead() {
+		errString := "Server " + vs.me + " is dead"
+		return errors.New(errString)
+	} else {
+		return vs.DrainImpl(args, reply)
+	}
+}
+
+// Remove Wrapper
+func (vs *ViewServer) Remove(args *AdminArgs, reply *AdminReply) error {
+	if vs.isdead() {
+		errString := "Server " + vs.me + " is dead"
+		return errors.New(errString)
+	} else {
+		return vs.RemoveImpl(args, reply)
+	}
+}
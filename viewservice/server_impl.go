@@ -3,15 +3,46 @@ package viewservice
 import (
 	"fmt"
 	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"umich.edu/eecs491/proj2/paxos"
 )
 
 // additions to ViewServer state.
 type ViewServerImpl struct {
+	// serializes Ping, Get and tick so that view transitions
+	// reach the log in the order they happen.
+	mu          sync.Mutex
 	currentView View
 	// proxyMap     map[string]*ServerProxy
 	primaryAcked bool
+	replicas     int // how many backups a view should have
+	pingInterval time.Duration
+	deadPings    int
+	phiThreshold float64 // > 0 if using the phi detector
+	clock        Clock
+	changed      chan struct{} // closed when the view moves on
+	announced    uint          // Viewnum watchers were last woken for
+	history      viewHistory
+	drained      map[string]bool // never to be primary or backup again
+	lastResult   Err             // of the last admin operation applied
+	unlogged     []ViewChange    // changes not yet in viewlog
+	viewlog      *viewLog        // nil unless Config.LogFile is set
+	logged       logRecord       // last record written to viewlog
+	px           *paxos.Paxos    // nil unless Config.Peers is set
+	peers        []string
+	nextSeq      int           // next Paxos instance to apply
+	snapshotSeq  int           // nextSeq as of the last snapshot
+	snapshotFile string        // where snapshots go, in replicated mode
+	lastEpoch    int64         // epoch of the last tick applied
+	leaseTime    time.Duration // granted to the primary per acked Ping
+	leaseUntil   time.Time     // when the primary's lease surely ends
+	leaseRevoked string        // primary whose lease is not to be renewed
 	adder        chan string
-	resetter     chan string
+	remover      chan string
+	resetter     chan heartbeat
 	current      chan map[string]*ServerProxy
 }
 
@@ -19,16 +50,60 @@ type ServerProxy struct {
 	ID               string
 	missedHeartbeats int
 	alive            bool
+	arrivals         arrivalWindow // for the phi detector
+}
+
+// a Ping from ID, received at Time.
+type heartbeat struct {
+	ID   string
+	Time time.Time
 }
 
 // your vs.impl.* initializations here.
-func (vs *ViewServer) initImpl() {
+func (vs *ViewServer) initImpl(cfg Config) {
 	vs.impl.currentView.Viewnum = 0
 	vs.impl.currentView.Primary = ""
 	vs.impl.currentView.Backup = ""
 	vs.impl.primaryAcked = false
+	vs.impl.replicas = cfg.Backups
+	if vs.impl.replicas < 1 {
+		vs.impl.replicas = 1
+	}
+	vs.impl.pingInterval = cfg.PingInterval
+	if vs.impl.pingInterval <= 0 {
+		vs.impl.pingInterval = PingInterval
+	}
+	vs.impl.deadPings = cfg.DeadPings
+	if vs.impl.deadPings <= 0 {
+		vs.impl.deadPings = DeadPings
+	}
+	switch cfg.Detector {
+	case "", CounterDetector:
+	case PhiDetector:
+		vs.impl.phiThreshold = cfg.PhiThreshold
+		if vs.impl.phiThreshold <= 0 {
+			vs.impl.phiThreshold = DefaultPhiThreshold
+		}
+	default:
+		log.Fatalf("viewservice: unknown failure detector %q", cfg.Detector)
+	}
+	vs.impl.clock = cfg.Clock
+	if vs.impl.clock == nil {
+		vs.impl.clock = realClock{}
+	}
+	vs.impl.leaseTime = cfg.Lease
+	if vs.impl.leaseTime == 0 {
+		vs.impl.leaseTime = vs.impl.pingInterval * time.Duration(vs.impl.deadPings-1)
+	}
+	vs.impl.history.size = cfg.HistorySize
+	if vs.impl.history.size <= 0 {
+		vs.impl.history.size = DefaultHistorySize
+	}
+	vs.impl.drained = make(map[string]bool)
+	vs.impl.changed = make(chan struct{})
 	vs.impl.adder = make(chan string)
-	vs.impl.resetter = make(chan string)
+	vs.impl.remover = make(chan string)
+	vs.impl.resetter = make(chan heartbeat)
 	vs.impl.current = make(chan map[string]*ServerProxy)
 
 	go func() {
@@ -39,21 +114,112 @@ func (vs *ViewServer) initImpl() {
 				if _, exists := proxymap[clientAddr]; !exists {
 					proxymap[clientAddr] = &ServerProxy{ID: clientAddr, alive: true, missedHeartbeats: 0}
 				}
-			case clientAddr := <-vs.impl.resetter:
-				proxymap[clientAddr].missedHeartbeats = 0
-				proxymap[clientAddr].alive = true
+			case clientAddr := <-vs.impl.remover:
+				delete(proxymap, clientAddr)
+			case hb := <-vs.impl.resetter:
+				proxy := proxymap[hb.ID]
+				if !proxy.alive {
+					// a gap while dead says nothing about
+					// how regularly it pings.
+					proxy.arrivals.reset()
+				}
+				proxy.missedHeartbeats = 0
+				proxy.alive = true
+				proxy.arrivals.heartbeat(hb.Time)
 			case vs.impl.current <- proxymap:
 			}
 		}
 	}()
+
+	if cfg.LogFile != "" && len(cfg.Peers) == 0 {
+		vs.replayLog(cfg.LogFile)
+	}
+}
+
+// open the view log and resume from its last record.
+func (vs *ViewServer) replayLog(path string) {
+	vl, records, err := openViewLog(path)
+	if err != nil {
+		log.Fatal("view log: ", err)
+	}
+	vs.impl.viewlog = vl
+	if len(records) == 0 {
+		return
+	}
+	for _, rec := range records {
+		for _, c := range rec.Changes {
+			vs.impl.history.add(c)
+		}
+	}
+
+	last := records[len(records)-1]
+	vs.impl.currentView = last.View
+	vs.impl.primaryAcked = last.PrimaryAcked
+	for _, server := range last.Drained {
+		vs.impl.drained[server] = true
+	}
+	vs.impl.logged = last
+	log.Printf("ViewServer(%v) resumed view %v from log\n", vs.me, last.View)
+
+	// track the servers in the view, so that they are declared
+	// dead if they never ping this incarnation. the primary may
+	// have been granted a lease just before the restart.
+	now := vs.impl.clock.Now()
+	vs.impl.leaseUntil = now.Add(vs.impl.leaseTime)
+	if last.View.Primary != "" {
+		vs.add(last.View.Primary)
+		vs.reset(last.View.Primary, now)
+	}
+	for _, backup := range last.View.Backups {
+		vs.add(backup)
+		vs.reset(backup, now)
+	}
+}
+
+// append the current view, ack state and drained servers to
+// the log if any have changed since the last record. must be
+// called with vs.impl.mu held, before the new view is handed out.
+func (vs *ViewServer) persist() {
+	if vs.impl.viewlog == nil {
+		return
+	}
+	rec := logRecord{View: vs.impl.currentView, PrimaryAcked: vs.impl.primaryAcked,
+		Drained: vs.drainedList(), Changes: vs.impl.unlogged}
+	if rec.View.Equal(vs.impl.logged.View) && rec.PrimaryAcked == vs.impl.logged.PrimaryAcked &&
+		sameStrings(rec.Drained, vs.impl.logged.Drained) {
+		return
+	}
+	if err := vs.impl.viewlog.append(rec); err != nil {
+		log.Fatal("view log: ", err)
+	}
+	vs.impl.logged = rec
+	vs.impl.unlogged = nil
+}
+
+// note that the view has just changed, and why.
+func (vs *ViewServer) record(reason string, server string, now time.Time) {
+	c := ViewChange{View: vs.impl.currentView, Reason: reason, Server: server, Time: now}
+	vs.impl.history.add(c)
+	if vs.impl.viewlog != nil {
+		vs.impl.unlogged = append(vs.impl.unlogged, c)
+	}
+}
+
+func (vs *ViewServer) closeLog() {
+	vs.impl.mu.Lock()
+	defer vs.impl.mu.Unlock()
+	if vs.impl.viewlog != nil {
+		vs.impl.viewlog.close()
+		vs.impl.viewlog = nil
+	}
 }
 
 func (vs *ViewServer) add(clientAddr string) {
 	vs.impl.adder <- clientAddr
 }
 
-func (vs *ViewServer) reset(clientAddr string) {
-	vs.impl.resetter <- clientAddr
+func (vs *ViewServer) reset(clientAddr string, now time.Time) {
+	vs.impl.resetter <- heartbeat{ID: clientAddr, Time: now}
 }
 
 func (vs *ViewServer) get() map[string]*ServerProxy {
@@ -63,10 +229,16 @@ func (vs *ViewServer) get() map[string]*ServerProxy {
 func (vs *ViewServer) IncrementView() {
 	vs.impl.currentView.Viewnum++
 	vs.impl.primaryAcked = false
+	// a revoked lease stays revoked until its holder is replaced.
+	if vs.impl.leaseRevoked != vs.impl.currentView.Primary {
+		vs.impl.leaseRevoked = ""
+	}
 }
 
 func (vs *ViewServer) NeedBackup(clientAddr string) bool {
-	return vs.impl.currentView.Backup == "" && vs.impl.currentView.Primary != "" && vs.impl.currentView.Primary != clientAddr
+	return len(vs.impl.currentView.Backups) < vs.impl.replicas && !vs.impl.drained[clientAddr] &&
+		vs.impl.currentView.Primary != "" && vs.impl.currentView.Primary != clientAddr &&
+		!vs.impl.currentView.IsBackup(clientAddr)
 }
 
 func (vs *ViewServer) PrimaryRestart(clientAddr string, viewnum uint) bool {
@@ -77,54 +249,214 @@ func (vs *ViewServer) PrimaryAck(clientAddr string, viewnum uint) bool {
 	return vs.impl.currentView.Primary == clientAddr && vs.impl.currentView.Viewnum == viewnum
 }
 
+// the lease a Ping from clientAddr with viewnum earns: the acked
+// primary gets one, unless it is about to be replaced.
+func (vs *ViewServer) leaseFor(clientAddr string, viewnum uint) time.Duration {
+	if vs.impl.leaseTime > 0 && vs.PrimaryAck(clientAddr, viewnum) &&
+		vs.impl.leaseRevoked != clientAddr {
+		return vs.impl.leaseTime
+	}
+	return 0
+}
+
+// might the primary still be acting on a lease, as of now?
+func (vs *ViewServer) leaseHeld(now time.Time) bool {
+	return now.Before(vs.impl.leaseUntil)
+}
+
 // Ping() RPC handler implementation
 func (vs *ViewServer) PingImpl(args *PingArgs, reply *PingReply) error {
-	clientAddr := args.Me
-	clientViewnum := args.Viewnum
+	vs.impl.mu.Lock()
+	defer vs.impl.mu.Unlock()
+
+	if vs.impl.px != nil {
+		entry := LogEntry{Kind: "Ping", Me: args.Me, Viewnum: args.Viewnum,
+			Time: vs.impl.clock.Now().UnixNano()}
+		if !vs.agree(entry) {
+			return fmt.Errorf("ViewServer(%v): no agreement on Ping", vs.me)
+		}
+	} else {
+		vs.ping(args.Me, args.Viewnum, vs.impl.clock.Now())
+		vs.persist()
+		vs.announce()
+	}
+	reply.View = vs.impl.currentView
+	reply.Peers = vs.impl.peers
+	reply.PingInterval = vs.impl.pingInterval
+	reply.DeadPings = vs.impl.deadPings
+	reply.Lease = vs.leaseFor(args.Me, args.Viewnum)
+	return nil
+}
+
+// apply a Ping from clientAddr, received at now, to the view state.
+func (vs *ViewServer) ping(clientAddr string, clientViewnum uint, now time.Time) {
 	// fmt.Println("ping from", clientAddr)
 	// Checking for new client, only adds if doesn't exist
 	vs.add(clientAddr)
 	// First ping, add primary
-	if vs.impl.currentView.Viewnum == 0 {
+	if vs.impl.currentView.Viewnum == 0 && !vs.impl.drained[clientAddr] {
 		// Add primary
 		// fmt.Println("adding primary", clientAddr)
 		vs.impl.currentView.Viewnum = 1
 		vs.impl.currentView.Primary = clientAddr
+		vs.record(ReasonInitialPrimary, clientAddr, now)
 	} else if vs.NeedBackup(clientAddr) {
 		// Add backup
 		// fmt.Println("adding backup", clientAddr)
 		// fmt.Println(("Incrementing view number"))
 		vs.IncrementView()
-		vs.impl.currentView.Backup = clientAddr
+		vs.setBackups(append(vs.impl.currentView.Backups, clientAddr))
+		vs.record(ReasonBackupAdded, clientAddr, now)
 	} else if vs.PrimaryRestart(clientAddr, clientViewnum) {
 		// Primary restart
 		// fmt.Println("primary restart")
-		vs.handleFailure(clientAddr)
+		vs.handleFailure(clientAddr, ReasonPrimaryRestart, now)
 	} else if vs.PrimaryAck(clientAddr, clientViewnum) {
 		vs.impl.primaryAcked = true
 	}
+	if lease := vs.leaseFor(clientAddr, clientViewnum); lease > 0 {
+		vs.impl.leaseUntil = now.Add(lease)
+	}
 
-	reply.View = vs.impl.currentView
-	vs.reset(clientAddr)
-	return nil
+	vs.reset(clientAddr, now)
 }
 
 // Get() RPC handler implementation
 func (vs *ViewServer) GetImpl(args *GetArgs, reply *GetReply) error {
+	vs.impl.mu.Lock()
+	defer vs.impl.mu.Unlock()
+
+	if vs.impl.px != nil && !vs.agree(LogEntry{Kind: "Get", Time: vs.impl.clock.Now().UnixNano()}) {
+		return fmt.Errorf("ViewServer(%v): no agreement on Get", vs.me)
+	}
+	reply.View = vs.impl.currentView
+	reply.Peers = vs.impl.peers
+	reply.PingInterval = vs.impl.pingInterval
+	reply.DeadPings = vs.impl.deadPings
+	return nil
+}
+
+// History() RPC handler implementation
+func (vs *ViewServer) HistoryImpl(args *HistoryArgs, reply *HistoryReply) error {
+	vs.impl.mu.Lock()
+	defer vs.impl.mu.Unlock()
+
+	if vs.impl.px != nil {
+		vs.catchUp()
+	}
+	reply.Changes = vs.impl.history.list()
+	reply.Peers = vs.impl.peers
+	return nil
+}
+
+// longest a Watch() may wait for a new view.
+const maxWatchTimeout = 10 * time.Second
+
+// Watch() RPC handler implementation
+func (vs *ViewServer) WatchImpl(args *WatchArgs, reply *WatchReply) error {
+	timeout := args.Timeout
+	if timeout <= 0 {
+		timeout = vs.impl.pingInterval * time.Duration(vs.impl.deadPings)
+	}
+	if timeout > maxWatchTimeout {
+		timeout = maxWatchTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	vs.impl.mu.Lock()
+	defer vs.impl.mu.Unlock()
+	waiting := true
+	for waiting {
+		if vs.impl.px != nil {
+			vs.catchUp()
+		}
+		if vs.impl.currentView.Viewnum > args.AfterViewnum {
+			break
+		}
+		changed := vs.impl.changed
+		vs.impl.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			waiting = false
+		case <-vs.dead:
+			waiting = false
+		}
+		vs.impl.mu.Lock()
+	}
+
+	// make sure the view is still current, as Get does.
+	if vs.impl.px != nil && !vs.agree(LogEntry{Kind: "Get", Time: vs.impl.clock.Now().UnixNano()}) {
+		return fmt.Errorf("ViewServer(%v): no agreement on Watch", vs.me)
+	}
 	reply.View = vs.impl.currentView
+	reply.Peers = vs.impl.peers
+	reply.PingInterval = vs.impl.pingInterval
+	reply.DeadPings = vs.impl.deadPings
 	return nil
 }
 
+// wake up any Watch()ers if the view has moved on.
+// vs.impl.mu must be held.
+func (vs *ViewServer) announce() {
+	if vs.impl.currentView.Viewnum != vs.impl.announced {
+		vs.impl.announced = vs.impl.currentView.Viewnum
+		close(vs.impl.changed)
+		vs.impl.changed = make(chan struct{})
+	}
+}
+
 func (vs *ViewServer) idleAvailable(proxy *ServerProxy) bool {
 	if proxy.ID != vs.impl.currentView.Primary &&
-		proxy.ID != vs.impl.currentView.Backup &&
-		proxy.alive {
+		!vs.impl.currentView.IsBackup(proxy.ID) &&
+		!vs.impl.drained[proxy.ID] && proxy.alive {
 		return true
 	}
 	return false
 }
 
-func (vs *ViewServer) handleFailure(proxyID string) {
+// the proxies in ID order, so that every replica of the
+// viewservice makes the same choices.
+func (vs *ViewServer) sortedProxies() []*ServerProxy {
+	proxymap := vs.get()
+	proxies := make([]*ServerProxy, 0, len(proxymap))
+	for _, proxy := range proxymap {
+		proxies = append(proxies, proxy)
+	}
+	sort.Slice(proxies, func(i, j int) bool {
+		return proxies[i].ID < proxies[j].ID
+	})
+	return proxies
+}
+
+// install a new list of backups, keeping View.Backup in step.
+// the list is copied, since old views may still share it.
+func (vs *ViewServer) setBackups(backups []string) {
+	vs.impl.currentView.Backups = append([]string(nil), backups...)
+	vs.impl.currentView.Backup = ""
+	if len(backups) > 0 {
+		vs.impl.currentView.Backup = backups[0]
+	}
+}
+
+// add idle servers as backups until there are enough.
+func (vs *ViewServer) refillBackups() {
+	backups := vs.impl.currentView.Backups
+	for _, proxy := range vs.sortedProxies() {
+		if len(backups) >= vs.impl.replicas {
+			break
+		}
+		if vs.idleAvailable(proxy) {
+			// Promote idle to backup
+			backups = append(backups, proxy.ID)
+			vs.setBackups(backups)
+		}
+	}
+}
+
+// move past the failure of proxyID, for the given reason.
+func (vs *ViewServer) handleFailure(proxyID string, reason string, now time.Time) {
 	// Primary failed
 	if proxyID == vs.impl.currentView.Primary {
 		// Check if old primary hasn't acked
@@ -132,54 +464,82 @@ func (vs *ViewServer) handleFailure(proxyID string) {
 			fmt.Println("Old primary hasn't acked")
 			return
 		}
-		// Safe to promote backup to primary
-		vs.impl.currentView.Primary = vs.impl.currentView.Backup
+		// nor while it may still be serving reads on its lease,
+		// unless it has restarted and so dropped the lease.
+		if reason != ReasonPrimaryRestart && vs.leaseHeld(now) {
+			return
+		}
+		// Safe to promote first backup to primary
+		backups := vs.impl.currentView.Backups
+		vs.impl.currentView.Primary = ""
+		if len(backups) > 0 {
+			vs.impl.currentView.Primary = backups[0]
+			backups = backups[1:]
+		}
 		log.Println("Promoting backup to primary: ", vs.impl.currentView.Primary)
-		// No backup (for now)
-		vs.impl.currentView.Backup = ""
+		vs.setBackups(append([]string{}, backups...))
 		// Check for available idle servers
-		for _, proxy := range <-vs.impl.current {
-			fmt.Println(proxy.ID)
-			fmt.Println(proxy.alive)
-			if vs.idleAvailable(proxy) {
-				// Promote idle to backup
-				vs.impl.currentView.Backup = proxy.ID
-				break
-			}
-		}
+		vs.refillBackups()
 		vs.IncrementView()
-	} else if proxyID == vs.impl.currentView.Backup {
-		// Backup failed, no backup (for now)
-		vs.impl.currentView.Backup = ""
-		// Check for available idle servers
-		for _, proxy := range vs.get() {
-			if vs.idleAvailable(proxy) {
-				// Promote idle to backup
-				vs.impl.currentView.Backup = proxy.ID
-				break
+		vs.record(reason, proxyID, now)
+	} else if vs.impl.currentView.IsBackup(proxyID) {
+		// Backup failed, drop it from the list
+		backups := []string{}
+		for _, backup := range vs.impl.currentView.Backups {
+			if backup != proxyID {
+				backups = append(backups, backup)
 			}
 		}
+		vs.setBackups(backups)
+		// Check for available idle servers
+		vs.refillBackups()
 		vs.IncrementView()
+		vs.record(reason, proxyID, now)
 	}
 
 }
 
-// tick() is called once per PingInterval; it should notice
+// tick() is called once per ping interval; it should notice
 // if servers have died or recovered, and change the view
 // accordingly.
 func (vs *ViewServer) tick() {
-	for _, proxy := range vs.get() {
-		if proxy.missedHeartbeats < DeadPings {
-			proxy.missedHeartbeats++
-		}
+	vs.impl.mu.Lock()
+	defer vs.impl.mu.Unlock()
+
+	now := vs.impl.clock.Now()
+	if vs.impl.px != nil {
+		vs.agree(LogEntry{Kind: "Tick", Epoch: vs.epoch(now), Time: now.UnixNano()})
+		return
+	}
+	vs.detectFailures(now)
+	vs.persist()
+	vs.announce()
+}
 
-		if proxy.missedHeartbeats >= DeadPings {
+// has this server stopped pinging, as of now?
+func (vs *ViewServer) suspect(proxy *ServerProxy, now time.Time) bool {
+	if vs.impl.phiThreshold > 0 {
+		return proxy.arrivals.phi(now, vs.impl.pingInterval) >= vs.impl.phiThreshold
+	}
+
+	// count a missed ping against the server
+	if proxy.missedHeartbeats < vs.impl.deadPings {
+		proxy.missedHeartbeats++
+	}
+	return proxy.missedHeartbeats >= vs.impl.deadPings
+}
+
+// find servers that have stopped pinging, and handle
+// those that are part of the view.
+func (vs *ViewServer) detectFailures(now time.Time) {
+	for _, proxy := range vs.sortedProxies() {
+		if vs.suspect(proxy, now) {
 			proxy.alive = false
-			if proxy.ID == vs.impl.currentView.Primary ||
-				proxy.ID == vs.impl.currentView.Backup {
-				vs.handleFailure(proxy.ID)
+			if proxy.ID == vs.impl.currentView.Primary {
+				vs.handleFailure(proxy.ID, ReasonPrimaryTimeout, now)
+			} else if vs.impl.currentView.IsBackup(proxy.ID) {
+				vs.handleFailure(proxy.ID, ReasonBackupTimeout, now)
 			}
 		}
 	}
-
 }
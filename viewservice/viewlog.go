@@ -0,0 +1,86 @@
+package viewservice
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+)
+
+//
+// The view log is an append-only file holding one record per
+// view transition (or change in the primary's ack). Each record
+// is a JSON object on its own line and is fsync()ed before the
+// ViewServer replies to the Ping that caused it, so a pinger
+// never sees a view that would be forgotten by a restart.
+//
+// On startup the log is replayed and the last complete record
+// becomes the current state. A torn final line (from a crash
+// in the middle of a write) is cut off so that later appends
+// start on a clean boundary.
+//
+
+type logRecord struct {
+	View         View
+	PrimaryAcked bool
+	Drained      []string     `json:",omitempty"`
+	Changes      []ViewChange `json:",omitempty"` // that led to View
+}
+
+type viewLog struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+// open (or create) the log at path, returning it along with
+// every complete record already in it.
+func openViewLog(path string) (*viewLog, []logRecord, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records := []logRecord{}
+	dec := json.NewDecoder(f)
+	good := int64(0)
+	for {
+		var rec logRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// partially-written last record
+			if err := f.Truncate(good); err != nil {
+				f.Close()
+				return nil, nil, err
+			}
+			break
+		}
+		records = append(records, rec)
+		good = dec.InputOffset()
+	}
+
+	vl := &viewLog{f: f, w: bufio.NewWriter(f)}
+	return vl, records, nil
+}
+
+// append a record and force it to stable storage.
+func (vl *viewLog) append(rec logRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err := vl.w.Write(b); err != nil {
+		return err
+	}
+	if err := vl.w.Flush(); err != nil {
+		return err
+	}
+	return vl.f.Sync()
+}
+
+func (vl *viewLog) close() error {
+	return vl.f.Close()
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -204,3 +205,802 @@ func Test1(t *testing.T) {
 
 	vs.Kill(vsterm)
 }
+
+func TestPersistentViews(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	vshost := port("pv")
+	logfile := port("pv-log")
+	os.Remove(logfile)
+	defer os.Remove(logfile)
+
+	vsterm := make(chan interface{})
+	vs := StartServerWithConfig(vshost, Config{LogFile: logfile}, vsterm)
+
+	ck1 := MakeClerk(port("p1"), vshost)
+	ck2 := MakeClerk(port("p2"), vshost)
+	ck3 := MakeClerk(port("p3"), vshost)
+
+	fmt.Printf("Test: Restarted viewserver keeps its view ...\n")
+
+	{
+		ck1.Ping(0)
+		ck1.Ping(1)
+		ck2.Ping(0)
+		ck1.Ping(2)
+		check(t, ck1, ck1.me, ck2.me, 2)
+
+		vs.Kill(vsterm)
+		vsterm = make(chan interface{})
+		vs = StartServerWithConfig(vshost, Config{LogFile: logfile}, vsterm)
+
+		check(t, ck1, ck1.me, ck2.me, 2)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Restarted viewserver does not hand out primary ...\n")
+
+	{
+		ck3.Ping(0)
+		check(t, ck3, ck1.me, ck2.me, 2)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Restarted viewserver keeps numbering views ...\n")
+
+	{
+		// ck2 stays silent; the acked primary is allowed
+		// to move on to a new view with ck3 as backup.
+		for i := 0; i < DeadPings+1; i++ {
+			ck1.Ping(2)
+			ck3.Ping(0)
+			time.Sleep(PingInterval)
+		}
+		check(t, ck1, ck1.me, ck3.me, 3)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill(vsterm)
+}
+
+func TestReplicated(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const npeers = 3
+	peers := make([]string, npeers)
+	for i := 0; i < npeers; i++ {
+		peers[i] = port("rv" + strconv.Itoa(i))
+	}
+	var vsa [npeers]*ViewServer
+	var vsterm [npeers]chan interface{}
+	start := func(i int) {
+		vsterm[i] = make(chan interface{})
+		vsa[i] = StartServerWithConfig(peers[i],
+			Config{Peers: peers, LogFile: peers[i] + ".log"}, vsterm[i])
+	}
+	for i := 0; i < npeers; i++ {
+		os.Remove(peers[i] + ".log")
+		os.Remove(peers[i] + ".log.paxos")
+		defer os.Remove(peers[i] + ".log")
+		defer os.Remove(peers[i] + ".log.paxos")
+		start(i)
+	}
+
+	// ck1 and ck2 only know about the first peer, and
+	// must learn the others.
+	ck1 := MakeClerk(port("r1"), peers[0])
+	ck2 := MakeClerk(port("r2"), peers[0])
+	ck3 := MakeReplicatedClerk(port("r3"), peers)
+
+	fmt.Printf("Test: Replicated first primary and backup ...\n")
+
+	{
+		ck1.Ping(0)
+		ck1.Ping(1)
+		ck2.Ping(0)
+		ck1.Ping(2)
+		check(t, ck1, ck1.me, ck2.me, 2)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Peers agree on the view ...\n")
+
+	for i := 0; i < npeers; i++ {
+		ck := MakeClerk("", peers[i])
+		check(t, ck, ck1.me, ck2.me, 2)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Clerks fail over when a peer dies ...\n")
+
+	{
+		vsa[0].Kill(vsterm[0])
+		for i := 0; i < 3; i++ {
+			if _, err := ck1.Ping(2); err != nil {
+				t.Fatalf("Ping did not fail over: %v", err)
+			}
+			ck2.Ping(2)
+			time.Sleep(PingInterval)
+		}
+		check(t, ck1, ck1.me, ck2.me, 2)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Backup takes over on a surviving peer ...\n")
+
+	{
+		for i := 0; i < DeadPings+1; i++ {
+			ck2.Ping(2)
+			ck3.Ping(0)
+			time.Sleep(PingInterval)
+		}
+		check(t, ck2, ck2.me, ck3.me, 3)
+		check(t, MakeClerk("", peers[1]), ck2.me, ck3.me, 3)
+		check(t, MakeClerk("", peers[2]), ck2.me, ck3.me, 3)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Peers agree on a forced failover ...\n")
+
+	{
+		// keep both alive while PromoteBackup waits out ck2's lease.
+		ck2.Ping(3)
+		ck3.Ping(3)
+		done := make(chan bool)
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(PingInterval):
+					ck2.Ping(3)
+					ck3.Ping(3)
+				}
+			}
+		}()
+		_, err := MakeClerk("", peers[1]).PromoteBackup()
+		close(done)
+		if err != OK {
+			t.Fatalf("PromoteBackup: %v", err)
+		}
+		check(t, MakeClerk("", peers[1]), ck3.me, ck2.me, 4)
+		check(t, MakeClerk("", peers[2]), ck3.me, ck2.me, 4)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	// keep the servers pinging from here on, so that the view
+	// only changes if the peers lose track of it.
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(PingInterval):
+				ck2.Ping(4)
+				ck3.Ping(4)
+			}
+		}
+	}()
+	defer close(done)
+
+	fmt.Printf("Test: A peer without a majority fails Get ...\n")
+
+	{
+		vsa[2].Kill(vsterm[2])
+		if v, ok := MakeClerk("", peers[1]).Get(); ok {
+			t.Fatalf("lone peer answered Get with %v", v)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Views survive every peer restarting ...\n")
+
+	{
+		vsa[1].Kill(vsterm[1])
+		time.Sleep(PingInterval)
+		for i := 0; i < npeers; i++ {
+			start(i)
+		}
+		// a peer that was down for long has a lot of log to
+		// catch up on before it can answer.
+		for i := 0; i < npeers; i++ {
+			ck := MakeClerk("", peers[i])
+			for iters := 0; iters < 10; iters++ {
+				if _, ok := ck.Get(); ok {
+					break
+				}
+			}
+			check(t, ck, ck3.me, ck2.me, 4)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	for i := 0; i < npeers; i++ {
+		vsa[i].Kill(vsterm[i])
+	}
+}
+
+func TestTwoBackups(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	vshost := port("tb")
+	vsterm := make(chan interface{})
+	vs := StartServerWithConfig(vshost, Config{Backups: 2}, vsterm)
+
+	ck1 := MakeClerk(port("t1"), vshost)
+	ck2 := MakeClerk(port("t2"), vshost)
+	ck3 := MakeClerk(port("t3"), vshost)
+	ck4 := MakeClerk(port("t4"), vshost)
+
+	fmt.Printf("Test: Views fill up to two backups ...\n")
+
+	{
+		ck1.Ping(0)
+		ck1.Ping(1)
+		ck2.Ping(0)
+		ck1.Ping(2)
+		ck3.Ping(0)
+		ck1.Ping(3)
+		ck4.Ping(0)
+		v, _ := ck1.Get()
+		if v.Viewnum != 3 || v.Primary != ck1.me ||
+			len(v.Backups) != 2 || v.Backups[0] != ck2.me || v.Backups[1] != ck3.me {
+			t.Fatalf("wrong view %v", v)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: First backup promoted, idle server refills ...\n")
+
+	{
+		for i := 0; i < DeadPings+1; i++ {
+			ck2.Ping(3)
+			ck3.Ping(3)
+			ck4.Ping(0)
+			time.Sleep(PingInterval)
+		}
+		v, _ := ck2.Get()
+		if v.Viewnum != 4 || v.Primary != ck2.me || v.Backup != ck3.me ||
+			len(v.Backups) != 2 || v.Backups[0] != ck3.me || v.Backups[1] != ck4.me {
+			t.Fatalf("wrong view %v", v)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill(vsterm)
+}
+
+func TestConfiguredTiming(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const interval = 20 * time.Millisecond
+	const deadpings = 3
+
+	vshost := port("ct")
+	vsterm := make(chan interface{})
+	vs := StartServerWithConfig(vshost,
+		Config{PingInterval: interval, DeadPings: deadpings}, vsterm)
+
+	ck1 := MakeClerk(port("c1"), vshost)
+	ck2 := MakeClerk(port("c2"), vshost)
+
+	fmt.Printf("Test: Viewserver advertises its timing ...\n")
+
+	{
+		if _, _, ok := ck1.Timing(); ok {
+			t.Fatalf("timing known before any Ping")
+		}
+		ck1.Ping(0)
+		pi, dp, ok := ck1.Timing()
+		if !ok || pi != interval || dp != deadpings {
+			t.Fatalf("wanted timing %v/%v, got %v/%v", interval, deadpings, pi, dp)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Failure detected with configured timing ...\n")
+
+	{
+		ck1.Ping(1)
+		ck2.Ping(0)
+		ck1.Ping(2)
+		check(t, ck1, ck1.me, ck2.me, 2)
+
+		// well under the default PingInterval * DeadPings.
+		for i := 0; i < deadpings+2; i++ {
+			ck2.Ping(2)
+			time.Sleep(interval)
+		}
+		check(t, ck2, ck2.me, "", 3)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill(vsterm)
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestPhiWindow(t *testing.T) {
+	fmt.Printf("Test: Phi grows with silence ...\n")
+
+	expected := 100 * time.Millisecond
+	start := time.Unix(1000, 0)
+	{
+		var w arrivalWindow
+		now := start
+		for i := 0; i < 20; i++ {
+			w.heartbeat(now)
+			now = now.Add(expected)
+		}
+		last := now.Add(-expected)
+		if phi := w.phi(last.Add(expected), expected); phi > 1 {
+			t.Fatalf("on-time server has phi %v", phi)
+		}
+		if phi := w.phi(last.Add(2*expected), expected); phi < DefaultPhiThreshold {
+			t.Fatalf("regular server silent for two intervals has phi %v", phi)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Phi tolerates irregular pingers ...\n")
+
+	{
+		var w arrivalWindow
+		now := start
+		for i := 0; i < 20; i++ {
+			w.heartbeat(now)
+			if i%2 == 0 {
+				now = now.Add(50 * time.Millisecond)
+			} else {
+				now = now.Add(250 * time.Millisecond)
+			}
+		}
+		if phi := w.phi(w.last.Add(3*expected), expected); phi >= DefaultPhiThreshold {
+			t.Fatalf("irregular server has phi %v after %v", phi, 3*expected)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPhiDetector(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const interval = 20 * time.Millisecond
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+
+	vshost := port("phi")
+	vsterm := make(chan interface{})
+	vs := StartServerWithConfig(vshost, Config{
+		PingInterval: interval,
+		Detector:     PhiDetector,
+		Clock:        clock,
+	}, vsterm)
+
+	ck1 := MakeClerk(port("f1"), vshost)
+	ck2 := MakeClerk(port("f2"), vshost)
+
+	ck1.Ping(0)
+	ck1.Ping(1)
+	ck2.Ping(0)
+	ck1.Ping(2)
+	for i := 0; i < 10; i++ {
+		clock.Advance(100 * time.Millisecond)
+		ck1.Ping(2)
+		ck2.Ping(2)
+	}
+
+	fmt.Printf("Test: Phi detector ignores ticks while the clock stands still ...\n")
+
+	{
+		// many more ticks than DeadPings, but no time passes.
+		time.Sleep(20 * interval)
+		check(t, ck1, ck1.me, ck2.me, 2)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Phi detector declares a silent primary dead ...\n")
+
+	{
+		clock.Advance(300 * time.Millisecond)
+		ck2.Ping(2)
+		time.Sleep(5 * interval)
+		check(t, ck2, ck2.me, "", 3)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill(vsterm)
+}
+
+func TestWatch(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	vshost := port("w")
+	vsterm := make(chan interface{})
+	vs := StartServer(vshost, vsterm)
+
+	ck1 := MakeClerk(port("w1"), vshost)
+	ck2 := MakeClerk(port("w2"), vshost)
+	ck3 := MakeClerk(port("w3"), vshost)
+
+	fmt.Printf("Test: Watch times out without a view change ...\n")
+
+	{
+		start := time.Now()
+		v, ok := ck3.Watch(0, 200*time.Millisecond)
+		if !ok || v.Viewnum != 0 {
+			t.Fatalf("Watch -> %v, %v; wanted view 0", v, ok)
+		}
+		if d := time.Since(start); d < 150*time.Millisecond {
+			t.Fatalf("Watch returned after %v, before its timeout", d)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Watch returns as soon as the view changes ...\n")
+
+	{
+		views := make(chan View)
+		go func() {
+			v, _ := ck3.Watch(0, 5*time.Second)
+			views <- v
+		}()
+		time.Sleep(100 * time.Millisecond)
+		start := time.Now()
+		ck1.Ping(0)
+		v := <-views
+		if v.Viewnum != 1 || v.Primary != ck1.me {
+			t.Fatalf("Watch -> %v; wanted view 1 with primary %v", v, ck1.me)
+		}
+		if d := time.Since(start); d > PingInterval {
+			t.Fatalf("Watch took %v to notice the new view", d)
+		}
+
+		// an old view number returns immediately.
+		start = time.Now()
+		v, ok := ck3.Watch(0, 5*time.Second)
+		if !ok || v.Viewnum != 1 || time.Since(start) > PingInterval {
+			t.Fatalf("Watch(0) -> %v after %v", v, time.Since(start))
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Subscribe delivers new views in order ...\n")
+
+	{
+		views, stop := ck3.Subscribe()
+		v := <-views
+		if v.Viewnum != 1 {
+			t.Fatalf("first view %v, wanted 1", v.Viewnum)
+		}
+
+		ck1.Ping(1)
+		ck2.Ping(0)
+		v = <-views
+		if v.Viewnum != 2 || v.Backup != ck2.me {
+			t.Fatalf("second view %v, wanted 2 with backup %v", v, ck2.me)
+		}
+
+		// ck1 acks, then dies; ck2 takes over.
+		ck1.Ping(2)
+		for i := 0; i < DeadPings*3; i++ {
+			ck2.Ping(2)
+			time.Sleep(PingInterval)
+		}
+		v = <-views
+		if v.Viewnum != 3 || v.Primary != ck2.me {
+			t.Fatalf("third view %v, wanted 3 with primary %v", v, ck2.me)
+		}
+
+		stop()
+		for range views {
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill(vsterm)
+}
+
+func TestHistory(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	vshost := port("h")
+	logfile := port("h-log")
+	os.Remove(logfile)
+	defer os.Remove(logfile)
+
+	vsterm := make(chan interface{})
+	vs := StartServerWithConfig(vshost, Config{LogFile: logfile}, vsterm)
+
+	ck1 := MakeClerk(port("h1"), vshost)
+	ck2 := MakeClerk(port("h2"), vshost)
+	ck3 := MakeClerk(port("h3"), vshost)
+
+	fmt.Printf("Test: History records why each view changed ...\n")
+
+	want := []ViewChange{
+		{Reason: ReasonInitialPrimary, Server: ck1.me},
+		{Reason: ReasonBackupAdded, Server: ck2.me},
+		{Reason: ReasonPrimaryRestart, Server: ck1.me},
+		{Reason: ReasonBackupTimeout, Server: ck1.me},
+		{Reason: ReasonBackupAdded, Server: ck3.me},
+		{Reason: ReasonPrimaryTimeout, Server: ck2.me},
+	}
+	compare := func(changes []ViewChange) {
+		if len(changes) != len(want) {
+			t.Fatalf("wanted %v changes, got %v", len(want), changes)
+		}
+		for i, c := range changes {
+			if c.View.Viewnum != uint(i+1) || c.Reason != want[i].Reason ||
+				c.Server != want[i].Server {
+				t.Fatalf("change %v is %v; wanted view %v, %q by %v",
+					i, c, i+1, want[i].Reason, want[i].Server)
+			}
+			if i > 0 && c.Time.Before(changes[i-1].Time) {
+				t.Fatalf("change %v is older than the one before", i)
+			}
+		}
+	}
+
+	{
+		ck1.Ping(0)
+		ck2.Ping(0)
+		ck1.Ping(2)
+		check(t, ck1, ck1.me, ck2.me, 2)
+
+		ck1.Ping(0)
+		check(t, ck2, ck2.me, ck1.me, 3)
+
+		for i := 0; i < DeadPings+1; i++ {
+			ck2.Ping(3)
+			time.Sleep(PingInterval)
+		}
+		check(t, ck2, ck2.me, "", 4)
+
+		ck2.Ping(4)
+		ck3.Ping(0)
+		ck2.Ping(5)
+		check(t, ck2, ck2.me, ck3.me, 5)
+
+		for i := 0; i < DeadPings+1; i++ {
+			ck3.Ping(5)
+			time.Sleep(PingInterval)
+		}
+		check(t, ck3, ck3.me, "", 6)
+
+		changes, ok := ck3.History()
+		if !ok {
+			t.Fatalf("History failed")
+		}
+		compare(changes)
+		if changes[5].View.Primary != ck3.me {
+			t.Fatalf("last change has view %v", changes[5].View)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: History survives a restart ...\n")
+
+	{
+		vs.Kill(vsterm)
+		vsterm = make(chan interface{})
+		vs = StartServerWithConfig(vshost, Config{LogFile: logfile}, vsterm)
+
+		changes, ok := ck3.History()
+		if !ok {
+			t.Fatalf("History failed")
+		}
+		compare(changes)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill(vsterm)
+}
+
+func TestHistoryRing(t *testing.T) {
+	fmt.Printf("Test: History keeps only the most recent changes ...\n")
+
+	h := viewHistory{size: 3}
+	for i := 1; i <= 5; i++ {
+		h.add(ViewChange{View: View{Viewnum: uint(i)}})
+		list := h.list()
+		first := 1
+		if i > 3 {
+			first = i - 2
+		}
+		if len(list) != i-first+1 {
+			t.Fatalf("after %v changes, history has %v", i, len(list))
+		}
+		for j, c := range list {
+			if c.View.Viewnum != uint(first+j) {
+				t.Fatalf("after %v changes, history is %v", i, list)
+			}
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestAdmin(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	vshost := port("ad")
+	vsterm := make(chan interface{})
+	vs := StartServer(vshost, vsterm)
+
+	ck1 := MakeClerk(port("a1"), vshost)
+	ck2 := MakeClerk(port("a2"), vshost)
+	ck3 := MakeClerk(port("a3"), vshost)
+	ck4 := MakeClerk(port("a4"), vshost)
+	admin := MakeClerk("", vshost)
+
+	expect := func(v View, err Err, wanted Err, p string, b string, n uint) {
+		if err != wanted {
+			t.Fatalf("got %v, wanted %v", err, wanted)
+		}
+		if v.Primary != p || v.Backup != b || v.Viewnum != n {
+			t.Fatalf("wanted view %v(%v,%v), got %v", n, p, b, v)
+		}
+	}
+
+	fmt.Printf("Test: PromoteBackup waits for the primary's ack ...\n")
+
+	{
+		ck1.Ping(0)
+		ck2.Ping(0)
+		v, err := admin.PromoteBackup()
+		expect(v, err, ErrNotAcked, ck1.me, ck2.me, 2)
+
+		ck1.Ping(2)
+		v, err = admin.PromoteBackup()
+		expect(v, err, OK, ck2.me, ck1.me, 3)
+		check(t, ck2, ck2.me, ck1.me, 3)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Drained servers are moved out and never chosen ...\n")
+
+	{
+		ck3.Ping(0)
+		v, err := admin.Drain(ck3.me)
+		expect(v, err, OK, ck2.me, ck1.me, 3)
+
+		v, err = admin.Drain(ck1.me)
+		expect(v, err, ErrNotAcked, ck2.me, ck1.me, 3)
+
+		ck2.Ping(3)
+		v, err = admin.Drain(ck1.me)
+		expect(v, err, OK, ck2.me, "", 4)
+
+		// neither drained server becomes the backup.
+		ck1.Ping(0)
+		ck3.Ping(0)
+		ck2.Ping(4)
+		check(t, ck2, ck2.me, "", 4)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Removing the primary fails over ...\n")
+
+	{
+		ck4.Ping(0)
+		check(t, ck4, ck2.me, ck4.me, 5)
+
+		ck2.Ping(5)
+		v, err := admin.Remove(ck2.me)
+		expect(v, err, OK, ck4.me, "", 6)
+
+		ck4.Ping(6)
+		v, err = admin.Remove(ck4.me)
+		expect(v, err, ErrNoBackup, ck4.me, "", 6)
+
+		changes, _ := admin.History()
+		last := changes[len(changes)-1]
+		if last.Reason != ReasonRemoved || last.Server != ck2.me {
+			t.Fatalf("last change is %v", last)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill(vsterm)
+}
+
+func TestLease(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	vshost := port("ls")
+	vsterm := make(chan interface{})
+	vs := StartServer(vshost, vsterm)
+
+	ck1 := MakeClerk(port("l1"), vshost)
+	ck2 := MakeClerk(port("l2"), vshost)
+	admin := MakeClerk("", vshost)
+	lease := PingInterval * (DeadPings - 1)
+
+	fmt.Printf("Test: Only the acked primary gets a lease ...\n")
+
+	{
+		ck1.Ping(0)
+		ck2.Ping(0)
+		check(t, ck1, ck1.me, ck2.me, 2)
+		if _, l, _ := ck1.PingLease(1); l != 0 {
+			t.Fatalf("primary got lease %v for an old view", l)
+		}
+		if _, l, _ := ck2.PingLease(2); l != 0 {
+			t.Fatalf("backup got lease %v", l)
+		}
+		if _, l, _ := ck1.PingLease(2); l != lease {
+			t.Fatalf("primary got lease %v, wanted %v", l, lease)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: PromoteBackup waits out the lease ...\n")
+
+	{
+		granted := time.Now()
+		ck1.PingLease(2)
+		ck2.Ping(2)
+		var reply AdminReply
+		admin.callAny("ViewServer.PromoteBackup", &AdminArgs{}, &reply, &reply.Peers)
+		if reply.Err != ErrLeaseHeld {
+			t.Fatalf("PromoteBackup during lease: %v", reply.Err)
+		}
+		if _, l, _ := ck1.PingLease(2); l != 0 {
+			t.Fatalf("revoked lease was renewed for %v", l)
+		}
+
+		v, err := admin.PromoteBackup()
+		if err != OK || v.Primary != ck2.me || v.Viewnum != 3 {
+			t.Fatalf("PromoteBackup: %v %v", err, v)
+		}
+		if time.Since(granted) < lease {
+			t.Fatalf("new primary chosen %v into a %v lease", time.Since(granted), lease)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: A restarted primary gives up its lease ...\n")
+
+	{
+		ck1.Ping(3)
+		if _, l, _ := ck2.PingLease(3); l != lease {
+			t.Fatalf("new primary got lease %v, wanted %v", l, lease)
+		}
+		ck2.Ping(0)
+		check(t, ck1, ck1.me, ck2.me, 4)
+	}
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill(vsterm)
+
+	fmt.Printf("Test: No leases if configured off ...\n")
+
+	{
+		vshost := port("ln")
+		vsterm := make(chan interface{})
+		vs := StartServerWithConfig(vshost, Config{Lease: -1}, vsterm)
+		ck := MakeClerk(port("n1"), vshost)
+		ck.Ping(0)
+		if _, l, _ := ck.PingLease(1); l != 0 {
+			t.Fatalf("got lease %v with leases off", l)
+		}
+		vs.Kill(vsterm)
+	}
+	fmt.Printf("  ... Passed\n")
+}